@@ -92,6 +92,15 @@ function getBackup() {
   }))
 }
 
+function getDiscoveredRoutes() {
+  return wrap(fetch('/cosmos/api/routes/discovered', {
+    method: 'GET',
+    headers: {
+      'Content-Type': 'application/json'
+    },
+  }))
+}
+
 export {
   get,
   set,
@@ -104,4 +113,5 @@ export {
   addRoute,
   canSendEmail,
   getBackup,
+  getDiscoveredRoutes,
 };
\ No newline at end of file
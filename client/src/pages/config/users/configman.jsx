@@ -116,6 +116,8 @@ const ConfigManagement = () => {
           ForceHTTPSCertificateRenewal: config.HTTPConfig.ForceHTTPSCertificateRenewal,
           OverrideWildcardDomains: config.HTTPConfig.OverrideWildcardDomains,
           UseForwardedFor: config.HTTPConfig.UseForwardedFor,
+          TrustedProxies: (config.HTTPConfig.TrustedProxies || []).join(', '),
+          EnableHTTP3: config.HTTPConfig.EnableHTTP3,
           AllowSearchEngine: config.HTTPConfig.AllowSearchEngine,
           AllowHTTPLocalIPAccess: config.HTTPConfig.AllowHTTPLocalIPAccess,
           PublishMDNS: config.HTTPConfig.PublishMDNS,
@@ -133,6 +135,7 @@ const ConfigManagement = () => {
 
           SkipPruneNetwork: config.DockerConfig.SkipPruneNetwork,
           SkipPruneImages: config.DockerConfig.SkipPruneImages,
+          AllowLabelRoutes: config.DockerConfig.AllowLabelRoutes,
           DefaultDataPath: config.DockerConfig.DefaultDataPath || "/usr",
 
           Background: config && config.HomepageConfig && config.HomepageConfig.Background,
@@ -205,6 +208,8 @@ const ConfigManagement = () => {
               ForceHTTPSCertificateRenewal: values.ForceHTTPSCertificateRenewal,
               OverrideWildcardDomains: values.OverrideWildcardDomains.replace(/\s/g, ''),
               UseForwardedFor: values.UseForwardedFor,
+              TrustedProxies: values.TrustedProxies.split(',').map((ip) => ip.trim()).filter((ip) => ip),
+              EnableHTTP3: values.EnableHTTP3,
               AllowSearchEngine: values.AllowSearchEngine,
               AllowHTTPLocalIPAccess: values.AllowHTTPLocalIPAccess,
               PublishMDNS: values.PublishMDNS,
@@ -225,6 +230,7 @@ const ConfigManagement = () => {
               ...config.DockerConfig,
               SkipPruneNetwork: values.SkipPruneNetwork,
               SkipPruneImages: values.SkipPruneImages,
+              AllowLabelRoutes: values.AllowLabelRoutes,
               DefaultDataPath: values.DefaultDataPath
             },
             HomepageConfig: {
@@ -751,6 +757,12 @@ const ConfigManagement = () => {
                     formik={formik}
                   />
 
+                  <CosmosCheckbox
+                    label={t('mgmt.config.docker.allowLabelRoutesCheckbox.allowLabelRoutesLabel')}
+                    name="AllowLabelRoutes"
+                    formik={formik}
+                  />
+
                   <Stack direction={"row"} spacing={2} alignItems="flex-end">
                     <FilePickerButton onPick={(path) => {
                       if(path)
@@ -770,11 +782,12 @@ const ConfigManagement = () => {
               <MainCard title={t('global.securityTitle')}>
                   <Grid container spacing={3}>
 
-                  {/* <CosmosCheckbox
-                    label={"Read Client IP from X-Forwarded-For header (not recommended)"}
-                    name="UseForwardedFor"
+                  <CosmosInputText
+                    name="TrustedProxies"
+                    label={t('mgmt.config.security.trustedProxiesInput.trustedProxiesLabel')}
                     formik={formik}
-                  /> */}
+                    placeholder={"172.17.0.1, 10.0.0.0/8"}
+                  />
 
                   <CosmosFormDivider title='Geo-Blocking' />
 
@@ -861,6 +874,14 @@ const ConfigManagement = () => {
                     formik={formik}
                   />
 
+                  {formik.values.HTTPSCertificateMode !== "DISABLED" && (
+                    <CosmosCheckbox
+                      label={t('mgmt.config.security.encryption.http3Checkbox.http3Label')}
+                      name="EnableHTTP3"
+                      formik={formik}
+                    />
+                  )}
+
                   {formik.values.UseWildcardCertificate && (
                     <CosmosInputText
                       name="OverrideWildcardDomains"
@@ -4,7 +4,7 @@ import MainCard from '../../../components/MainCard';
 import { Formik, Field } from 'formik';
 import * as Yup from 'yup';
 import { useTheme } from '@mui/material/styles';
-import { WarningOutlined, PlusCircleOutlined, CopyOutlined, ExclamationCircleOutlined , SyncOutlined, UserOutlined, KeyOutlined, QuestionCircleFilled, QuestionCircleOutlined } from '@ant-design/icons';
+import { WarningOutlined, PlusCircleOutlined, CopyOutlined, ExclamationCircleOutlined , SyncOutlined, UserOutlined, KeyOutlined, QuestionCircleFilled, QuestionCircleOutlined, ContainerOutlined } from '@ant-design/icons';
 import {
   Alert,
   Button,
@@ -70,6 +70,7 @@ const ProxyManagement = () => {
   const [needSave, setNeedSave] = React.useState(false);
   const [openNewModal, setOpenNewModal] = React.useState(false);
   const [isLoading, setIsLoading] = React.useState(false);
+  const [discoveredRoutes, setDiscoveredRoutes] = React.useState([]);
 
   function setRouteEnabled(key) {
     return (event) => {
@@ -86,7 +87,8 @@ const ProxyManagement = () => {
         ...config.HTTPConfig,
         ProxyConfig: {
           ...config.HTTPConfig.ProxyConfig,
-          Routes: routes,
+          // discovered routes only live in memory, they are never saved to the config
+          Routes: routes.filter((r) => !r._IsDiscovered),
         },
       },
     };
@@ -106,6 +108,9 @@ const ProxyManagement = () => {
     API.config.get().then((res) => {
       setConfig(res.data);
     });
+    API.config.getDiscoveredRoutes().then((res) => {
+      setDiscoveredRoutes(res.data || []);
+    });
   }
 
   function up(event, key) {
@@ -130,7 +135,7 @@ const ProxyManagement = () => {
 
   function down(event, key) {
     event.stopPropagation();
-    if (key < routes.length - 1) {
+    if (key < routes.length - 1 && !routes[key+1]._IsDiscovered) {
       let tmp = routes[key];
       routes[key] = routes[key+1];
       routes[key+1] = tmp;
@@ -174,6 +179,13 @@ const ProxyManagement = () => {
     routes = [...config.ConstellationConfig.Tunnels, ...routes];
   }
 
+  if (routes && discoveredRoutes.length) {
+    // append, configured routes take precedence
+    routes = [...routes, ...discoveredRoutes.map((r) => ({...r, _IsDiscovered: true}))];
+  }
+
+  const isReadOnly = (r) => r._IsTunnel || r._IsDiscovered;
+
   return <div style={{   }}>
     <Stack direction="row" spacing={1} style={{ marginBottom: '20px' }}>
       <Button variant="contained" color="primary" startIcon={<SyncOutlined />} onClick={() => {
@@ -190,8 +202,8 @@ const ProxyManagement = () => {
       
       {routes && <PrettyTableView 
         data={routes}
-        getKey={(r, k) => k + r.Name + r.Target + r.Mode + (r._IsTunnel ? '_tunnel' : '')}
-        linkTo={(r) => r._IsTunnel ? '' : ('/resios-ui/config-url/' + r.Name)}
+        getKey={(r, k) => k + r.Name + r.Target + r.Mode + (r._IsTunnel ? '_tunnel' : '') + (r._IsDiscovered ? '_discovered' : '')}
+        linkTo={(r) => isReadOnly(r) ? '' : ('/resios-ui/config-url/' + r.Name)}
         columns={[
           { 
             title: '', 
@@ -210,7 +222,11 @@ const ProxyManagement = () => {
                 display: 'block',
                 marginLeft: '10px',
               }} src={ConstellationIcon} />
-            </> : <Checkbox disabled={isLoading} size='large' color={!r.Disabled ? 'success' : 'default'}
+            </> : r._IsDiscovered ? <ContainerOutlined style={{
+                display: 'block',
+                marginLeft: '10px',
+                fontSize: '30px',
+              }} /> : <Checkbox disabled={isLoading} size='large' color={!r.Disabled ? 'success' : 'default'}
               onChange={setRouteEnabled(routes.indexOf(r))}
               checked={!r.Disabled}
             />,
@@ -241,7 +257,7 @@ const ProxyManagement = () => {
           { title: t('global.target'), screenMin: 'md', search: (r) => r.Target, field: (r) => <><RouteMode route={r} /> <Chip label={r.Target} /></> },
           { title: t('global.securityTitle'), screenMin: 'lg', field: (r) => <RouteSecurity route={r} />,
           style: {minWidth: '70px'} },
-          { title: '', clickable:true, field: (r, k) => r._IsTunnel ? <Tooltip title={t('tooltip.route.tunnelWarn')}>
+          { title: '', clickable:true, field: (r, k) => isReadOnly(r) ? <Tooltip title={r._IsTunnel ? t('tooltip.route.tunnelWarn') : t('tooltip.route.discoveredWarn')}>
             <QuestionCircleOutlined style={{
               // color: 'gray',
               fontSize: '20px',
@@ -46,7 +46,10 @@ export const redirectTo = (url) => {
 export const redirectToLocal = (url) => {
   let redirectUrl = new URL(url, window.location.href);
   let currentLocation = window.location;
-  if (redirectUrl.origin != currentLocation.origin){
+  // allow subdomains, so forward-auth can send users back to apps behind another proxy
+  let isSubdomain = redirectUrl.protocol == currentLocation.protocol &&
+    redirectUrl.hostname.endsWith('.' + currentLocation.hostname);
+  if (redirectUrl.origin != currentLocation.origin && !isSubdomain){
     throw new Error("URL must be local");
   }
   window.location.href = url;
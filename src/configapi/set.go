@@ -7,6 +7,7 @@ import (
 	"github.com/aseracorp/resiOS/src/authorizationserver"
 	"github.com/aseracorp/resiOS/src/constellation"
 	"github.com/aseracorp/resiOS/src/cron"
+	"github.com/aseracorp/resiOS/src/docker"
 	"github.com/aseracorp/resiOS/src/storage"
 )
 
@@ -57,6 +58,10 @@ func ConfigApiSet(w http.ResponseWriter, req *http.Request) {
 		go (func() {
 			storage.Restart()
 			constellation.RestartNebula()
+			// the label routes depend on the settings
+			if _, err := docker.DiscoverRoutes(); err != nil {
+				utils.Error("Route discovery", err)
+			}
 			utils.RestartHTTPServer()
 			cron.InitJobs()
 			cron.InitScheduler()
@@ -593,6 +593,9 @@ func getYAMLClientConfig(name, configPath, capki, cert, key, APIKey string, devi
 			route.UseHost = true
 			
 			route.Target = protocol + configHostname + port
+			// the tunnel has a single entry point, the load balancing happens on this side
+			route.Targets = nil
+			route.LoadBalancingStrategy = ""
 
 			if configMap["cstln_https_insecure"].(bool) {
 				route.AcceptInsecureHTTPSTarget = true
@@ -69,6 +69,7 @@ func CheckPorts() error {
 
 	// Get the ports
 	ports := map[string]struct{}{}
+	udpPorts := map[string]struct{}{}
 	finalPorts := []string{}
 
 	for containerPort, hostConfig := range inspect.NetworkSettings.Ports {
@@ -77,6 +78,9 @@ func CheckPorts() error {
 		for _, hostPort := range hostConfig {
 			utils.Debug("Host port: " + hostPort.HostPort)
 			ports[hostPort.HostPort] = struct{}{}
+			if containerPort.Proto() == "udp" {
+				udpPorts[hostPort.HostPort] = struct{}{}
+			}
 			finalPorts = append(finalPorts, hostPort.HostPort + ":" + containerPort.Port() + "/" + containerPort.Proto())
 		}
 	}
@@ -98,6 +102,15 @@ func CheckPorts() error {
 		}
 	}
 
+	// HTTP/3 needs the UDP side of the HTTPS port
+	if isHTTPS && config.HTTPConfig.EnableHTTP3 {
+		if _, ok := udpPorts[HTTPSPort]; !ok {
+			utils.Debug("Port "+HTTPSPort+"/udp is not mapped. Adding it.")
+			finalPorts = append(finalPorts, HTTPSPort + ":" + HTTPSPort + "/udp")
+			hasChanged = true
+		}
+	}
+
 	if hasChanged {
 		utils.Log("Port mapping changed. Needs update.")
 		utils.Log("New ports: " + strings.Join(finalPorts, ", "))
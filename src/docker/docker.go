@@ -223,6 +223,11 @@ func EditContainer(oldContainerID string, newConfig types.ContainerJSON, noLock
 		// if no name, use the same one, that will force Docker to create a hostname if not set
 		newName = oldContainer.Name
 
+		// serve the maintenance page on the routes of this container while it is recreated
+		maintenanceName := strings.TrimPrefix(oldContainer.Name, "/")
+		utils.SetContainerMaintenance(maintenanceName, true)
+		defer utils.SetContainerMaintenance(maintenanceName, false)
+
 		// stop and remove container
 		stopError := DockerClient.ContainerStop(DockerContext, oldContainerID, container.StopOptions{})
 		if stopError != nil {
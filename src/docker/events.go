@@ -142,11 +142,13 @@ func onDockerStarted(containerID string) {
 	utils.Debug("onDockerStarted: " + containerID)
 	BootstrapContainerFromTags(containerID)
 	DebouncedExportDocker()
+	DebouncedRefreshDiscoveredRoutes()
 }
 
 func onDockerDestroyed(containerID string) {
 	utils.Debug("onDockerDestroyed: " + containerID)
 	DebouncedExportDocker()
+	DebouncedRefreshDiscoveredRoutes()
 }
 
 func onNetworkDisconnect(networkID string) {
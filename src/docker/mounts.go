@@ -0,0 +1,57 @@
+package docker
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aseracorp/resiOS/src/utils"
+)
+
+var hostPathCache = NewCache()
+
+// GetContainerHostPath translates a path inside a container to the host path of the volume or bind mount containing it
+func GetContainerHostPath(containerName string, containerPath string) (string, error) {
+	cacheKey := containerName + ":" + containerPath
+	if hostPath, found := hostPathCache.Get(cacheKey); found {
+		return hostPath, nil
+	}
+
+	errD := Connect()
+	if errD != nil {
+		return "", errD
+	}
+
+	container, err := DockerClient.ContainerInspect(DockerContext, containerName)
+	if err != nil {
+		return "", err
+	}
+
+	containerPath = path.Clean(containerPath)
+	bestMatch := ""
+	hostPath := ""
+
+	// the deepest mount containing the path wins
+	for _, mount := range container.Mounts {
+		destination := path.Clean(mount.Destination)
+		if containerPath != destination && !strings.HasPrefix(containerPath, destination + "/") {
+			continue
+		}
+
+		if len(destination) > len(bestMatch) && mount.Source != "" {
+			bestMatch = destination
+			hostPath = mount.Source + strings.TrimPrefix(containerPath, destination)
+		}
+	}
+
+	if hostPath == "" {
+		return "", fmt.Errorf("path %s is not in a volume or bind mount of container %s", containerPath, containerName)
+	}
+
+	utils.Debug("Docker - Host path of " + containerName + ":" + containerPath + " : " + hostPath)
+
+	hostPathCache.Set(cacheKey, hostPath, 10*time.Second)
+
+	return hostPath, nil
+}
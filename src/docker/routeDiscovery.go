@@ -0,0 +1,285 @@
+package docker
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aseracorp/resiOS/src/utils"
+
+	conttype "github.com/docker/docker/api/types/container"
+)
+
+// Containers can ask for routes with labels like:
+//   cosmos.route.<name>.host=app.example.com
+//   cosmos.route.<name>.port=8080
+//   cosmos.route.<name>.auth=true|false|admin
+//   cosmos.route.<name>.path_prefix=/app
+// and optionally .strip_path_prefix=true and .scheme=http|https.
+// They are only used when DockerConfig.AllowLabelRoutes is set, and can never take over
+// the Cosmos hostname or the host of a configured route
+const routeLabelPrefix = "cosmos.route."
+
+var (
+	discoveryTimer *time.Timer
+	discoveryInterval = 3 * time.Second
+	discoveryMu sync.Mutex
+)
+
+func parseBoolLabel(value string) bool {
+	b, err := strconv.ParseBool(strings.TrimSpace(value))
+	return err == nil && b
+}
+
+// getRouteHosts splits a host list, lowercase and without port
+func getRouteHosts(hostList string) []string {
+	hosts := []string{}
+	for _, host := range strings.Split(hostList, ",") {
+		host = strings.ToLower(strings.TrimSpace(host))
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if host != "" {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
+
+// getReservedHost returns the owner of the first host of the list already in use, if any
+func getReservedHost(hostList string, reserved map[string]string) string {
+	for _, host := range getRouteHosts(hostList) {
+		if owner, ok := reserved[host]; ok {
+			return owner
+		}
+	}
+	return ""
+}
+
+// RoutesFromLabels builds the routes requested by the labels of a container
+func RoutesFromLabels(containerName string, labels map[string]string) ([]utils.ProxyRouteConfig, []error) {
+	containerName = strings.TrimPrefix(containerName, "/")
+	routeLabels := map[string]map[string]string{}
+
+	for label, value := range labels {
+		if !strings.HasPrefix(label, routeLabelPrefix) {
+			continue
+		}
+
+		key := strings.TrimPrefix(label, routeLabelPrefix)
+		dot := strings.LastIndex(key, ".")
+		if dot <= 0 {
+			continue
+		}
+
+		name, option := key[:dot], key[dot+1:]
+		if routeLabels[name] == nil {
+			routeLabels[name] = map[string]string{}
+		}
+		routeLabels[name][option] = strings.TrimSpace(value)
+	}
+
+	routes := []utils.ProxyRouteConfig{}
+	errs := []error{}
+
+	for name, options := range routeLabels {
+		port := options["port"]
+		if _, err := strconv.Atoi(port); err != nil {
+			errs = append(errs, errors.New("route " + name + " of container " + containerName + " has no valid port label"))
+			continue
+		}
+
+		if options["host"] == "" && options["path_prefix"] == "" {
+			errs = append(errs, errors.New("route " + name + " of container " + containerName + " needs a host or a path_prefix label"))
+			continue
+		}
+
+		scheme := "http"
+		if options["scheme"] == "https" {
+			scheme = "https"
+		}
+
+		auth := strings.ToLower(options["auth"])
+
+		if _, ok := options["tls_passthrough"]; ok {
+			errs = append(errs, errors.New("route " + name + " of container " + containerName + " asks for TLS passthrough, which is only available on configured routes, ignoring the label"))
+		}
+
+		routes = append(routes, utils.ProxyRouteConfig{
+			Name: name,
+			Description: "Discovered from the labels of " + containerName,
+			Mode: "SERVAPP",
+			Target: scheme + "://" + containerName + ":" + port,
+			UseHost: options["host"] != "",
+			Host: options["host"],
+			UsePathPrefix: options["path_prefix"] != "",
+			PathPrefix: options["path_prefix"],
+			StripPathPrefix: parseBoolLabel(options["strip_path_prefix"]),
+			AuthEnabled: auth == "admin" || parseBoolLabel(auth),
+			AdminOnly: auth == "admin",
+			AcceptInsecureHTTPSTarget: scheme == "https",
+			Timeout: 14400000,
+			ThrottlePerMinute: 10000,
+			BlockCommonBots: true,
+			SmartShield: utils.SmartShieldPolicy{
+				Enabled: true,
+			},
+		})
+	}
+
+	return routes, errs
+}
+
+// DiscoverRoutes reads the labels of all the containers and stores the resulting routes.
+// It returns true if they changed since the last discovery
+func DiscoverRoutes() (bool, error) {
+	errD := Connect()
+	if errD != nil {
+		return false, errD
+	}
+
+	// stopped containers keep their routes, they are only removed when destroyed
+	containers, err := DockerClient.ContainerList(DockerContext, conttype.ListOptions{All: true})
+	if err != nil {
+		return false, err
+	}
+
+	config := utils.GetMainConfig()
+
+	configRoutes := map[string]bool{}
+	reservedHosts := map[string]string{}
+	for _, host := range getRouteHosts(config.HTTPConfig.Hostname) {
+		reservedHosts[host] = "the Cosmos hostname"
+	}
+	for _, route := range config.HTTPConfig.ProxyConfig.Routes {
+		configRoutes[route.Name] = true
+		if route.UseHost {
+			for _, host := range getRouteHosts(route.Host) {
+				reservedHosts[host] = "route " + route.Name
+			}
+		}
+	}
+
+	routes := []utils.ProxyRouteConfig{}
+	seen := map[string]string{}
+	// host and path prefix of the routes already discovered, two containers cannot serve the same ones
+	seenMatches := map[string]string{}
+
+	named := containers[:0]
+	for _, container := range containers {
+		if len(container.Names) > 0 {
+			named = append(named, container)
+		}
+	}
+	containers = named
+
+	// the first container in name order wins the conflicts
+	sort.Slice(containers, func(i, j int) bool {
+		return containers[i].Names[0] < containers[j].Names[0]
+	})
+
+	for _, container := range containers {
+		if !config.DockerConfig.AllowLabelRoutes {
+			break
+		}
+		containerName := strings.TrimPrefix(container.Names[0], "/")
+
+		containerRoutes, errs := RoutesFromLabels(containerName, container.Labels)
+		for _, err := range errs {
+			utils.Warn("Route discovery: " + err.Error())
+		}
+
+		sort.Slice(containerRoutes, func(i, j int) bool {
+			return containerRoutes[i].Name < containerRoutes[j].Name
+		})
+
+	routesLoop:
+		for _, route := range containerRoutes {
+			if configRoutes[route.Name] {
+				utils.Warn("Route discovery: route " + route.Name + " of container " + containerName + " has the same name as a configured route, ignoring")
+				continue
+			}
+			if other, ok := seen[route.Name]; ok {
+				utils.Warn("Route discovery: route " + route.Name + " of container " + containerName + " is already declared by " + other + ", ignoring")
+				continue
+			}
+			if owner := getReservedHost(route.Host, reservedHosts); owner != "" {
+				utils.Error("Route discovery: route " + route.Name + " of container " + containerName + " uses a host of " + owner + ", ignoring", nil)
+				continue
+			}
+
+			hosts := getRouteHosts(route.Host)
+			if len(hosts) == 0 {
+				hosts = []string{""}
+			}
+			matches := []string{}
+			for _, host := range hosts {
+				matches = append(matches, host + route.PathPrefix)
+			}
+			for _, match := range matches {
+				if owner, ok := seenMatches[match]; ok {
+					utils.Warn("Route discovery: route " + route.Name + " of container " + containerName + " serves " + match + ", already served by " + owner + ", ignoring")
+					continue routesLoop
+				}
+			}
+			for _, match := range matches {
+				seenMatches[match] = "route " + route.Name + " of container " + containerName
+			}
+
+			seen[route.Name] = containerName
+			routes = append(routes, route)
+		}
+	}
+
+	sort.Slice(routes, func(i, j int) bool {
+		return routes[i].Name < routes[j].Name
+	})
+
+	if reflect.DeepEqual(routes, utils.GetDiscoveredRoutes()) {
+		return false, nil
+	}
+
+	utils.SetDiscoveredRoutes(routes)
+	utils.Log("Route discovery: " + strconv.Itoa(len(routes)) + " route(s) discovered from container labels")
+
+	return true, nil
+}
+
+// RefreshDiscoveredRoutes re-reads the labels and reloads the proxy if the routes changed
+func RefreshDiscoveredRoutes() {
+	changed, err := DiscoverRoutes()
+	if err != nil {
+		utils.Error("Route discovery", err)
+		return
+	}
+
+	if changed {
+		utils.TriggerEvent(
+			"cosmos.proxy.route.discovered",
+			"Discovered routes updated",
+			"info",
+			"",
+			map[string]interface{}{
+				"routes": len(utils.GetDiscoveredRoutes()),
+		})
+
+		utils.RestartHTTPServer()
+	}
+}
+
+// DebouncedRefreshDiscoveredRoutes avoids restarting the server for every event of a compose stack
+func DebouncedRefreshDiscoveredRoutes() {
+	discoveryMu.Lock()
+	defer discoveryMu.Unlock()
+
+	if discoveryTimer != nil {
+		discoveryTimer.Stop()
+	}
+
+	discoveryTimer = time.AfterFunc(discoveryInterval, RefreshDiscoveredRoutes)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+
+	"github.com/aseracorp/resiOS/src/metrics"
+	"github.com/aseracorp/resiOS/src/utils"
+)
+
+var HTTPServer3 *http3.Server
+
+// bannedIPsQUICListener drops the QUIC connections of banned IPs, as BlockBannedIPs does for TCP
+type bannedIPsQUICListener struct {
+	*quic.EarlyListener
+}
+
+func (l bannedIPsQUICListener) Accept(ctx context.Context) (*quic.Conn, error) {
+	for {
+		conn, err := l.EarlyListener.Accept(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		ip, _ := utils.SplitIP(conn.RemoteAddr().String())
+		if utils.GetIPAbuseCounter(ip) > 300 {
+			conn.CloseWithError(0, "")
+			continue
+		}
+
+		return conn, nil
+	}
+}
+
+func http3Metrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !utils.GetMainConfig().MonitoringDisabled {
+			metrics.PushSetMetric("proxy.all.http3", 1, metrics.DataDef{
+				Max: 0,
+				Period: time.Second * 30,
+				Label: "Global HTTP/3 Requests",
+				AggloType: "sum",
+				SetOperation: "sum",
+			})
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// startHTTP3Server serves the same router over QUIC on the UDP side of the HTTPS port
+func startHTTP3Server(router http.Handler, tlsConf *tls.Config) {
+	addr := "0.0.0.0:" + serverPortHTTPS
+
+	udpConn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		utils.Error("HTTP/3: cannot listen on UDP " + addr, err)
+		return
+	}
+
+	// same certificate as the TCP listener, with h3 as the only ALPN
+	listener, err := quic.ListenEarly(udpConn, http3.ConfigureTLSConfig(tlsConf), &quic.Config{
+		MaxIdleTimeout: 30 * time.Second,
+	})
+	if err != nil {
+		udpConn.Close()
+		utils.Error("HTTP/3: cannot start QUIC listener", err)
+		return
+	}
+
+	port, _ := strconv.Atoi(serverPortHTTPS)
+
+	HTTPServer3 = &http3.Server{
+		Addr: addr,
+		Port: port,
+		Handler: http3Metrics(router),
+		IdleTimeout: 30 * time.Second,
+	}
+
+	server := HTTPServer3
+	go func() {
+		err := server.ServeListener(bannedIPsQUICListener{listener})
+		if err != nil && !errors.Is(err, http.ErrServerClosed) && !errors.Is(err, quic.ErrServerClosed) {
+			utils.Error("HTTP/3 server", err)
+		}
+		udpConn.Close()
+	}()
+
+	utils.Log("Listening to HTTP/3 on :" + serverPortHTTPS + "/udp")
+}
+
+// altSvcMiddleware advertises HTTP/3 to the clients connected over TCP
+func altSvcMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if server := HTTPServer3; server != nil && r.ProtoMajor < 3 {
+			server.SetQUICHeaders(w.Header())
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+    "net"
     "net/http"
 		"github.com/aseracorp/resiOS/src/utils"
 		"github.com/aseracorp/resiOS/src/user"
@@ -30,8 +31,25 @@ var serverPortHTTPS = ""
 var HTTPServer *http.Server
 var HTTPServer2 *http.Server
 
+// listen wraps the listener to read the PROXY protocol header sent by a load balancer in front of Cosmos
+func listen(addr string) (net.Listener, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	HTTPConfig := utils.GetMainConfig().HTTPConfig
+	if HTTPConfig.AcceptProxyProtocol {
+		utils.Log("Accepting PROXY protocol on " + addr)
+		return proxy.NewProxyProtocolListener(listener, HTTPConfig.ProxyProtocolTrustedIPs), nil
+	}
+
+	return listener, nil
+}
+
 func startHTTPServer(router *mux.Router) error {
 	HTTPServer2 = nil
+	HTTPServer3 = nil
 	HTTPServer = &http.Server{
 		Addr: "0.0.0.0:" + serverPortHTTP,
 		ReadTimeout: 0,
@@ -53,15 +71,21 @@ func startHTTPServer(router *mux.Router) error {
 		proxy.PublishAllMDNSFromConfig()
 	}
 
+	listener, err := listen(HTTPServer.Addr)
+	if err != nil {
+		return err
+	}
+
 	utils.Log("Listening to HTTP on : 0.0.0.0:" + serverPortHTTP)
 
-	return HTTPServer.ListenAndServe()
+	return HTTPServer.Serve(listener)
 }
 
 func startHTTPSServer(router *mux.Router) error {
 	//config  := utils.GetMainConfig()
 
 	utils.IsHTTPS = true
+	HTTPServer3 = nil
 		
 	// redirect http to https
 	go (func () {
@@ -98,7 +122,10 @@ func startHTTPSServer(router *mux.Router) error {
 			DisableGeneralOptionsHandler: true,
 		}
 
-		err := HTTPServer2.ListenAndServe()
+		listener, err := listen(HTTPServer2.Addr)
+		if err == nil {
+			err = HTTPServer2.Serve(listener)
+		}
 		
 		if err != nil && err != http.ErrServerClosed {
 			utils.Fatal("Listening to HTTP (Redirecting to HTTPS)", err)
@@ -125,6 +152,12 @@ func startHTTPSServer(router *mux.Router) error {
 
 	tlsConf.Certificates = []tls.Certificate{cert}
 
+	var handler http.Handler = router
+	if HTTPConfig.EnableHTTP3 {
+		startHTTP3Server(router, tlsConf)
+		handler = altSvcMiddleware(router)
+	}
+
 	HTTPServer = &http.Server{
 		TLSConfig: tlsConf,
 		Addr: "0.0.0.0:" + serverPortHTTPS,
@@ -132,7 +165,7 @@ func startHTTPSServer(router *mux.Router) error {
 		ReadHeaderTimeout: 10 * time.Second,
 		WriteTimeout: 0,
 		IdleTimeout: 30 * time.Second,
-		Handler: router,
+		Handler: handler,
 		DisableGeneralOptionsHandler: true,
 	}
 
@@ -148,9 +181,14 @@ func startHTTPSServer(router *mux.Router) error {
 		proxy.PublishAllMDNSFromConfig()
 	}
 
+	listener, err := listen(HTTPServer.Addr)
+	if err != nil {
+		return err
+	}
+
 	utils.Log("Now listening to HTTPS on :" + serverPortHTTPS)
 
-	return HTTPServer.ListenAndServeTLS("", "")
+	return HTTPServer.ServeTLS(proxy.NewSNIListener(listener), "", "")
 }
 
 func tokenMiddleware(next http.Handler) http.Handler {
@@ -378,8 +416,14 @@ func InitServer() *mux.Router {
 	logoAPI := router.PathPrefix("/logo").Subrouter()
 	SecureAPI(logoAPI, true, true)
 	logoAPI.HandleFunc("/", SendLogo)
-	
-	
+
+	// forward-auth for external reverse proxies: called once per proxied request from
+	// the same IP, so it does not go through SecureAPI's per-IP throttling nor hostname checks
+	forwardAuthAPI := router.PathPrefix("/cosmos/api/auth").Subrouter()
+	forwardAuthAPI.Use(utils.ContentTypeMiddleware("application/json"))
+	forwardAuthAPI.Use(utils.SetSecurityHeaders)
+	forwardAuthAPI.HandleFunc("/verify", user.ForwardAuthVerify)
+
 	srapi := router.PathPrefix("/cosmos").Subrouter()
 	srapi.Use(utils.ContentTypeMiddleware("application/json"))
 	
@@ -409,6 +453,7 @@ func InitServer() *mux.Router {
 	srapiAdmin.HandleFunc("/api/restart", configapi.ConfigApiRestart)
 	
 	srapiAdmin.HandleFunc("/api/invite", user.UserResendInviteLink)
+	srapiAdmin.HandleFunc("/api/users/{nickname}/unlock", user.UserUnlock)
 	srapiAdmin.HandleFunc("/api/users/{nickname}", user.UsersIdRoute)
 	srapiAdmin.HandleFunc("/api/users", user.UsersRoute)
 
@@ -438,6 +483,15 @@ func InitServer() *mux.Router {
 	srapiAdmin.HandleFunc("/api/servapps", docker.ContainersRoute)
 	srapiAdmin.HandleFunc("/api/docker-service", docker.CreateServiceRoute)
 	
+	srapiAdmin.HandleFunc("/api/routes/status", proxy.API_GetRoutesStatus)
+	srapiAdmin.HandleFunc("/api/routes/cache", proxy.API_RoutesCache)
+	srapiAdmin.HandleFunc("/api/routes/maintenance", proxy.API_RoutesMaintenance)
+	srapiAdmin.HandleFunc("/api/routes/discovered", proxy.API_GetDiscoveredRoutes)
+	srapiAdmin.HandleFunc("/api/routes/access-logs/{route}", proxy.API_GetAccessLogs)
+	srapiAdmin.HandleFunc("/api/routes/tokens", proxy.API_RouteTokens)
+	srapiAdmin.HandleFunc("/api/shield/bans", proxy.API_ShieldBans)
+	srapiAdmin.HandleFunc("/api/shield/allowlist", proxy.API_ShieldAllowlist)
+
 	srapiAdmin.HandleFunc("/api/markets", market.MarketGet)
 
 	srapiAdmin.HandleFunc("/api/upload/{name}", UploadImage)
@@ -577,6 +631,10 @@ func StartServer() {
 		config := utils.GetMainConfig()
 		HTTPConfig := config.HTTPConfig
 
+		if HTTPConfig.UseForwardedFor && len(HTTPConfig.TrustedProxies) == 0 {
+			utils.Warn("UseForwardedFor is deprecated and only trusts the loopback now, list the IPs of your reverse proxies in TrustedProxies")
+		}
+
 		var tlsCert = HTTPConfig.TLSCert
 		var tlsKey= HTTPConfig.TLSKey
 
@@ -615,6 +673,9 @@ func RestartServer() {
 		if HTTPServer2 != nil {
 			HTTPServer2.Shutdown(context.Background())
 		}
+		if HTTPServer3 != nil {
+			HTTPServer3.Close()
+		}
 		HTTPServer.Shutdown(context.Background())
 	}()
 
@@ -19,6 +19,7 @@ import (
 	"github.com/aseracorp/resiOS/src/storage"
 	"github.com/aseracorp/resiOS/src/cron"
 	"github.com/aseracorp/resiOS/src/proxy"
+	"github.com/aseracorp/resiOS/src/user"
 	
 	"github.com/kardianos/service"
 )
@@ -220,6 +221,8 @@ func cosmos() {
 	
 	// utils.ReBootstrapContainer = docker.BootstrapContainerFromTags
 	utils.PushShieldMetrics = metrics.PushShieldMetrics
+	utils.ShieldStrikeClient = proxy.StrikeClient
+	utils.NotifyAccountLocked = user.SendAccountLockedEmail
 	utils.GetContainerIPByName = docker.GetContainerIPByName
 	utils.DoesContainerExist = docker.DoesContainerExist
 	utils.CheckDockerNetworkMode = docker.CheckDockerNetworkMode
@@ -242,6 +245,10 @@ func cosmos() {
 
 	docker.BootstrapAllContainersFromTags()
 
+	if _, err := docker.DiscoverRoutes(); err != nil {
+		utils.Error("Route discovery", err)
+	}
+
 	docker.RemoveSelfUpdater()
 
 	go func() {
@@ -258,6 +265,7 @@ func cosmos() {
 
 	proxy.InitSocketShield()
 	proxy.InitUDPShield()
+	proxy.LoadShieldBans()
 
 	if !config.NewInstall {
 		MigratePre013()
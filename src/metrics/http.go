@@ -7,7 +7,8 @@ import (
 )
 
 
-func PushRequestMetrics(route utils.ProxyRouteConfig, statusCode int, TimeStarted time.Time, size int64) error {
+// upstream is the name of the load balanced target that answered, if any
+func PushRequestMetrics(route utils.ProxyRouteConfig, upstream string, statusCode int, TimeStarted time.Time, size int64) error {
 	responseTime := time.Since(TimeStarted)
 
 	if !utils.GetMainConfig().MonitoringDisabled {
@@ -45,6 +46,10 @@ func PushRequestMetrics(route utils.ProxyRouteConfig, statusCode int, TimeStarte
 			})
 		}
 
+		if upstream != "" {
+			pushUpstreamRequestMetrics(route, upstream, statusCode, responseTime)
+		}
+
 		PushSetMetric("proxy.all.time", int(responseTime.Milliseconds()), DataDef{
 			Max: 0,
 			Period: time.Second * 30,
@@ -87,6 +92,41 @@ func PushRequestMetrics(route utils.ProxyRouteConfig, statusCode int, TimeStarte
 	return nil
 }
 
+// pushUpstreamRequestMetrics splits the route metrics by target, to compare a canary with the stable version
+func pushUpstreamRequestMetrics(route utils.ProxyRouteConfig, upstream string, statusCode int, responseTime time.Duration) {
+	key := route.Name + "." + utils.SanitizeName(upstream)
+
+	if statusCode >= 400 {
+		PushSetMetric("proxy.upstream.error."+key, 1, DataDef{
+			Max: 0,
+			Period: time.Second * 30,
+			Label: "Request Errors " + route.Name + " (" + upstream + ")",
+			AggloType: "sum",
+			SetOperation: "sum",
+			Object: "route@" + route.Name,
+		})
+	} else {
+		PushSetMetric("proxy.upstream.success."+key, 1, DataDef{
+			Max: 0,
+			Period: time.Second * 30,
+			Label: "Request Success " + route.Name + " (" + upstream + ")",
+			AggloType: "sum",
+			SetOperation: "sum",
+			Object: "route@" + route.Name,
+		})
+	}
+
+	PushSetMetric("proxy.upstream.time."+key, int(responseTime.Milliseconds()), DataDef{
+		Max: 0,
+		Period: time.Second * 30,
+		Label: "Response Request " + route.Name + " (" + upstream + ")",
+		AggloType: "sum",
+		SetOperation: "sum",
+		Unit: "ms",
+		Object: "route@" + route.Name,
+	})
+}
+
 func PushShieldMetrics(reason string) {
 	reasonStr := map[string]string{
 		"bots": "Bots",
@@ -95,6 +135,7 @@ func PushShieldMetrics(reason string) {
 		"hostname": "By Hostname",
 		"ip-whitelists": "By IP Whitelists",
 		"smart-shield": "Smart Shield",
+		"waf": "By WAF",
 	}
 
 	PushSetMetric("proxy.blocked."+reason, 1, DataDef{
@@ -25,6 +25,7 @@ type SmartResponseWriterWrapper struct {
 	isOver bool
 	hasBeenInterrupted bool
 	isPrivileged bool
+	neverBanned bool
 	shieldID string
 }
 
@@ -59,7 +60,7 @@ func (w *SmartResponseWriterWrapper) WriteHeader(status int) {
 
 func (w *SmartResponseWriterWrapper) Write(p []byte) (int, error) {
 	userConsumed := shield.GetUserUsedBudgets(w.shieldID, w.ClientID)
-	if !w.isPrivileged && !shield.isAllowedToReqest(w.shieldID, w.policy, userConsumed) {
+	if !w.isPrivileged && !w.neverBanned && !shield.isAllowedToReqest(w.shieldID, w.policy, userConsumed) {
 		utils.Log(fmt.Sprintf("SmartShield: %s has been blocked due to abuse", w.ClientID))
 		w.isOver = true
 		w.TimeEnded = time.Now()
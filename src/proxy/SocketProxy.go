@@ -109,6 +109,9 @@ func startProxy(listenAddr string, target string, proxyInfo *ProxyInfo, isHTTPPr
     switch listenProtocol {
     case "tcp":
         listener, err = net.Listen("tcp", listenAddr)
+        if err == nil && route.AcceptProxyProtocol {
+            listener = NewProxyProtocolListener(listener, utils.GetMainConfig().HTTPConfig.ProxyProtocolTrustedIPs)
+        }
     case "udp":
         packetConn, err = net.ListenPacket("udp", listenAddr)
     default:
@@ -180,6 +183,17 @@ func handleTCPProxy(listener net.Listener, target string, proxyInfo *ProxyInfo,
                 shieldedClient.Close()
                 continue
             }
+
+            if route.SendProxyProtocol != "" && !isHTTPProxy {
+                err = WriteProxyProtocolHeader(server, route.SendProxyProtocol, shieldedClient.RemoteAddr(), shieldedClient.LocalAddr())
+                if err != nil {
+                    utils.Error("[SocketProxy] Failed to send PROXY protocol header", err)
+                    shieldedClient.Close()
+                    server.Close()
+                    continue
+                }
+            }
+
             go handleClient(shieldedClient, server, proxyInfo)
         }
     }
@@ -346,7 +360,7 @@ func InitInternalSocketProxy() {
     routesList = append(routesList, routes...)
 
 	for _, route := range routesList {
-		if route.UseHost && strings.Contains(route.Host, ":") && !route.Disabled {
+		if route.UseHost && strings.Contains(route.Host, ":") && !route.Disabled && !route.TLSPassthrough {
 			hostname := route.Host
 			port := strings.Split(hostname, ":")[1]
             // if port is a number
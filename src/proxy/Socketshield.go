@@ -125,7 +125,9 @@ func (shield *TCPSmartShieldState) GetUserUsedBudgets(shieldID string, clientID
 	return userConsumed
 }
 
-func (shield *TCPSmartShieldState) IsAllowedToConnect(shieldID string, policy utils.SmartShieldPolicy, userConsumed TCPUserUsedBudget) bool {
+// IsAllowedToConnect checks the bans and the budgets of the client, the bans are issued in the name of the route
+// so they follow its escalation
+func (shield *TCPSmartShieldState) IsAllowedToConnect(routeName string, policy utils.SmartShieldPolicy, userConsumed TCPUserUsedBudget) bool {
 	if(!policy.Enabled) {
 		return true
 	}
@@ -138,53 +140,17 @@ func (shield *TCPSmartShieldState) IsAllowedToConnect(shieldID string, policy ut
 
 	clientID := userConsumed.ClientID
 
-	if clientID == "192.168.1.1" || clientID == "192.168.0.1" || clientID == "192.168.0.254" || clientID == "172.17.0.1" {
+	if isShieldAllowlisted(clientID, policy) {
 		return true
 	}
 
-	nbTempBans := 0
-	nbStrikes := 0
-
-	for _, ban := range globalShieldState.bans {
-		if ban.ClientID != clientID {
-			continue
-		}
-
-		switch ban.BanType {
-		case PERM:
-			return false
-		case TEMP:
-			if ban.time.Add(4 * time.Hour).After(time.Now()) {
-				return false
-			} else if ban.time.Add(72 * time.Hour).After(time.Now()) {
-				nbTempBans++
-			}
-		case STRIKE:
-			if ban.time.Add(time.Hour).After(time.Now()) {
-				return false
-			} else if ban.time.Add(24 * time.Hour).After(time.Now()) {
-				nbStrikes++
-			}
-		}
-	}
-
-	if nbTempBans >= 3 {
-		globalShieldState.bans = append(globalShieldState.bans, &UserBan{
-			ClientID: clientID,
-			BanType:  PERM,
-			time:     time.Now(),
-			shieldID: shieldID,
-		})
+	blocked, newBan := globalShieldState.escalateBans(clientID, routeName, getShieldEscalation(policy))
+	if newBan != nil && newBan.BanType == PERM {
 		utils.Warn(fmt.Sprintf("TCP User %s has been banned permanently: %+v", clientID, userConsumed))
-		return false
-	} else if nbStrikes >= 3 {
-		globalShieldState.bans = append(globalShieldState.bans, &UserBan{
-			ClientID: clientID,
-			BanType:  TEMP,
-			time:     time.Now(),
-			shieldID: shieldID,
-		})
+	} else if newBan != nil {
 		utils.Warn(fmt.Sprintf("TCP User %s has been banned temporarily: %+v", clientID, userConsumed))
+	}
+	if blocked {
 		return false
 	}
 
@@ -192,12 +158,11 @@ func (shield *TCPSmartShieldState) IsAllowedToConnect(shieldID string, policy ut
 		(userConsumed.Packets > int64(policy.PerUserRequestLimit*1000*policy.PolicyStrictness)) ||
 		(userConsumed.Bytes > policy.PerUserByteLimit*int64(policy.PolicyStrictness)) ||
 		(userConsumed.Simultaneous > policy.PerUserSimultaneous*policy.PolicyStrictness) {
-		globalShieldState.bans = append(globalShieldState.bans, &UserBan{
+		globalShieldState.addBan(&UserBan{
 			ClientID: clientID,
 			BanType:  STRIKE,
-			time:     time.Now(),
-			reason:   fmt.Sprintf("%+v out of %+v", userConsumed, policy),
-			shieldID: shieldID,
+			Reason:   fmt.Sprintf("%+v out of %+v", userConsumed, policy),
+			Route:    routeName,
 		})
 		utils.Warn(fmt.Sprintf("TCP User %s has received a strike: %+v", clientID, userConsumed))
 		return false
@@ -344,12 +309,11 @@ func (shield *TCPSmartShieldState) EnforceBudget() {
 				"clientID": conn.ClientID,
 			})
 
-			globalShieldState.bans = append(globalShieldState.bans, &UserBan{
+			globalShieldState.addBan(&UserBan{
 				ClientID: conn.ClientID,
 				BanType:  STRIKE,
-				time:     time.Now(),
-				reason:   fmt.Sprintf("%+v out of %+v", userConsumed, policy),
-				shieldID: conn.ShieldID,
+				Reason:   fmt.Sprintf("%+v out of %+v", userConsumed, policy),
+				Route:    conn.Route.Name,
 			})
 		}
 	}
@@ -391,7 +355,7 @@ func (w *TCPConnectionWrapper) Close() error {
 			"clientID": w.ClientID,
 		})
 
-		go metrics.PushRequestMetrics(w.Route, 0, w.TimeStarted, w.Bytes)
+		go metrics.PushRequestMetrics(w.Route, "", 0, w.TimeStarted, w.Bytes)
 	}
 	
 	return w.Conn.Close()
@@ -403,6 +367,7 @@ func InitSocketShield() {
 
 func TCPSmartShieldMiddleware(shieldID string, route utils.ProxyRouteConfig) func(net.Conn) net.Conn {
 	policy := route.SmartShield
+	registerBanEscalation(route.Name, policy)
 
 	if policy.Enabled {
 		if(policy.PerUserTimeBudget == 0) {
@@ -564,7 +529,7 @@ func TCPSmartShieldMiddleware(shieldID string, route utils.ProxyRouteConfig) fun
 		
 		userConsumed := socketShield.GetUserUsedBudgets(shieldID, clientID)
 
-		if !socketShield.IsAllowedToConnect(shieldID, policy, userConsumed) {
+		if !socketShield.IsAllowedToConnect(route.Name, policy, userConsumed) {
 			utils.TriggerEvent(
 				"cosmos.proxy.shield.abuse." + route.Name,
 				"Socket Shield " + route.Name + " Abuse by " + clientID,
@@ -67,6 +67,7 @@ func cleanupUDPConnections() {
 
 func UDPSmartShieldMiddleware(shieldID string, route utils.ProxyRouteConfig) func([]byte, net.Addr) []byte {
 	policy := route.SmartShield
+	registerBanEscalation(route.Name, policy)
 	if policy.Enabled {
 		if(policy.PerUserByteLimit == 0) {
 			policy.PerUserByteLimit = 150 * 1024 * 1024 * 1024 // 150GB
@@ -83,7 +84,7 @@ func UDPSmartShieldMiddleware(shieldID string, route utils.ProxyRouteConfig) fun
 			return nil
 		}
 
-		if !(clientID == "192.168.1.1" || clientID == "192.168.0.1" || clientID == "192.168.0.254" || clientID == "172.17.0.1") {
+		if !isShieldAllowlisted(clientID, policy) {
 			// Whitelist / Constellation check
 			if !isAllowedIP(clientID, route) {
 				return nil
@@ -97,6 +98,9 @@ func UDPSmartShieldMiddleware(shieldID string, route utils.ProxyRouteConfig) fun
 			udpShield.Lock()
 			defer udpShield.Unlock()
 
+			globalShieldState.Lock()
+			defer globalShieldState.Unlock()
+
 			key := fmt.Sprintf("%s-%s", shieldID, clientID)
 			info, exists := udpShield.Connections[key]
 			if !exists {
@@ -126,60 +130,23 @@ func UDPSmartShieldMiddleware(shieldID string, route utils.ProxyRouteConfig) fun
 
 				utils.Debug(fmt.Sprintf("UDP User %s has been banned: %+v", clientID, info.BytesSent))
 
-				globalShieldState.bans = append(globalShieldState.bans, &UserBan{
+				globalShieldState.addBan(&UserBan{
 					ClientID: info.ClientID,
 					BanType:  STRIKE,
-					time:     time.Now(),
-					reason:   fmt.Sprintf("%+v out of %+v", info.BytesSent, policy.PerUserByteLimit),
-					shieldID: info.ShieldID,
+					Reason:   fmt.Sprintf("%+v out of %+v", info.BytesSent, policy.PerUserByteLimit),
+					Route:    route.Name,
 				})
 				
 				return nil
 			}
 
-			nbTempBans := 0
-			nbStrikes := 0
-
-			for _, ban := range globalShieldState.bans {
-				if ban.ClientID != clientID {
-					continue
-				}
-
-				switch ban.BanType {
-				case PERM:
-					return  nil
-				case TEMP:
-					if ban.time.Add(4 * time.Hour).After(time.Now()) {
-						return nil
-					} else if ban.time.Add(72 * time.Hour).After(time.Now()) {
-						nbTempBans++
-					}
-				case STRIKE:
-					if ban.time.Add(time.Hour).After(time.Now()) {
-						return nil
-					} else if ban.time.Add(24 * time.Hour).After(time.Now()) {
-						nbStrikes++
-					}
-				}
-			}
-
-			if nbTempBans >= 3 {
-				globalShieldState.bans = append(globalShieldState.bans, &UserBan{
-					ClientID: clientID,
-					BanType:  PERM,
-					time:     time.Now(),
-					shieldID: shieldID,
-				})
+			blocked, newBan := globalShieldState.escalateBans(clientID, route.Name, getShieldEscalation(policy))
+			if newBan != nil && newBan.BanType == PERM {
 				utils.Warn(fmt.Sprintf("UDP User %s has been banned permanently: %+v", clientID, info.BytesSent))
-				return nil
-			} else if nbStrikes >= 3 {
-				globalShieldState.bans = append(globalShieldState.bans, &UserBan{
-					ClientID: clientID,
-					BanType:  TEMP,
-					time:     time.Now(),
-					shieldID: shieldID,
-				})
+			} else if newBan != nil {
 				utils.Warn(fmt.Sprintf("UDP User %s has been banned temporarily: %+v", clientID, info.BytesSent))
+			}
+			if blocked {
 				return nil
 			}
 
@@ -0,0 +1,287 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/middleware"
+	"github.com/gorilla/mux"
+	"gopkg.in/natefinch/lumberjack.v2"
+
+	"github.com/aseracorp/resiOS/src/utils"
+)
+
+type AccessLogEntry struct {
+	Time time.Time `json:"time"`
+	Route string `json:"route"`
+	ClientIP string `json:"clientIP"`
+	User string `json:"user,omitempty"`
+	Method string `json:"method"`
+	Host string `json:"host"`
+	URI string `json:"uri"`
+	Proto string `json:"proto"`
+	Status int `json:"status"`
+	Bytes int `json:"bytes"`
+	LatencyMs float64 `json:"latencyMs"`
+	Upstream string `json:"upstream,omitempty"`
+	Shield string `json:"shield"`
+	Referer string `json:"referer,omitempty"`
+	UserAgent string `json:"userAgent,omitempty"`
+}
+
+var accessLogWriters = map[string]*lumberjack.Logger{}
+var accessLogWritersLock sync.Mutex
+
+// getAccessLogPath is the file of a route. Names changed by the sanitizing get a hash of the original,
+// so a/b and a_b do not share a file
+func getAccessLogPath(routeName string) string {
+	name := utils.SanitizeName(routeName)
+	if name != routeName {
+		hash := fnv.New32a()
+		hash.Write([]byte(routeName))
+		name += "-" + strconv.FormatUint(uint64(hash.Sum32()), 16)
+	}
+	return utils.CONFIGFOLDER + "access-logs/" + name + ".log"
+}
+
+func getAccessLogFormat(route utils.ProxyRouteConfig) string {
+	if format, ok := utils.AccessLogFormatList[strings.ToUpper(route.AccessLog.Format)]; ok {
+		return format
+	}
+	return utils.AccessLogFormatList["JSON"]
+}
+
+// getAccessLogWriter keeps one rotating file per route across the restarts of the router
+func getAccessLogWriter(route utils.ProxyRouteConfig) (*lumberjack.Logger, error) {
+	config := route.AccessLog
+
+	maxSize := config.MaxSize
+	if maxSize <= 0 {
+		maxSize = 10
+	}
+	maxBackups := config.MaxBackups
+	if maxBackups <= 0 {
+		maxBackups = 3
+	}
+	maxAge := config.MaxAge
+	if maxAge <= 0 {
+		maxAge = 30
+	}
+
+	path := getAccessLogPath(route.Name)
+
+	accessLogWritersLock.Lock()
+	defer accessLogWritersLock.Unlock()
+
+	if writer, ok := accessLogWriters[path]; ok {
+		if writer.MaxSize == maxSize && writer.MaxBackups == maxBackups && writer.MaxAge == maxAge {
+			return writer, nil
+		}
+		writer.Close()
+	}
+
+	if err := os.MkdirAll(utils.CONFIGFOLDER + "access-logs", 0750); err != nil {
+		return nil, err
+	}
+
+	writer := &lumberjack.Logger{
+		Filename: path,
+		MaxSize: maxSize, // megabytes
+		MaxBackups: maxBackups,
+		MaxAge: maxAge, // days
+		Compress: true,
+	}
+	accessLogWriters[path] = writer
+
+	return writer, nil
+}
+
+func clfValue(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+func clfQuote(value string) string {
+	return "\"" + strings.ReplaceAll(strings.ReplaceAll(clfValue(value), "\\", "\\\\"), "\"", "\\\"") + "\""
+}
+
+// FormatAccessLog returns the line of an entry, without the line break
+func FormatAccessLog(format string, entry AccessLogEntry) string {
+	if format == "COMMON" || format == "COMBINED" {
+		bytes := "-"
+		if entry.Bytes > 0 {
+			bytes = strconv.Itoa(entry.Bytes)
+		}
+
+		line := fmt.Sprintf("%s - %s [%s] %s %d %s",
+			entry.ClientIP,
+			clfValue(strings.ReplaceAll(entry.User, " ", "_")),
+			entry.Time.Format("02/Jan/2006:15:04:05 -0700"),
+			clfQuote(entry.Method + " " + entry.URI + " " + entry.Proto),
+			entry.Status,
+			bytes)
+
+		if format == "COMBINED" {
+			line += " " + clfQuote(entry.Referer) + " " + clfQuote(entry.UserAgent)
+		}
+
+		return line
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return ""
+	}
+	return string(line)
+}
+
+// AccessLogMiddleware writes one line per request of the route, it has to wrap the other middlewares to see the shield decisions
+func AccessLogMiddleware(route utils.ProxyRouteConfig) func(next http.Handler) http.Handler {
+	format := getAccessLogFormat(route)
+
+	writer, err := getAccessLogWriter(route)
+	if err != nil {
+		utils.Error("AccessLog: cannot open the access log of route " + route.Name, err)
+		return func(next http.Handler) http.Handler {
+			return next
+		}
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r, info := withRouteRequestInfo(r)
+			ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+
+			start := time.Now()
+			clientIP := GetClientID(r, route)
+			uri := r.RequestURI
+			if uri == "" {
+				uri = r.URL.RequestURI()
+			}
+
+			next.ServeHTTP(ww, r)
+
+			status := ww.Status()
+			if status == 0 {
+				status = http.StatusOK
+			}
+
+			shield := info.Shield()
+			if shield == "" {
+				shield = "allowed"
+				if status == http.StatusForbidden || status == http.StatusTooManyRequests {
+					shield = "blocked"
+				}
+			}
+
+			line := FormatAccessLog(format, AccessLogEntry{
+				Time: start,
+				Route: route.Name,
+				ClientIP: clientIP,
+				// set by the auth middleware once the token is verified
+				User: r.Header.Get("x-cosmos-user"),
+				Method: r.Method,
+				Host: r.Host,
+				URI: uri,
+				Proto: r.Proto,
+				Status: status,
+				Bytes: ww.BytesWritten(),
+				LatencyMs: float64(time.Since(start).Microseconds()) / 1000,
+				Upstream: info.Upstream(),
+				Shield: shield,
+				Referer: r.Referer(),
+				UserAgent: r.UserAgent(),
+			})
+
+			if _, err := writer.Write([]byte(line + "\n")); err != nil {
+				utils.Error("AccessLog: cannot write the access log of route " + route.Name, err)
+			}
+		})
+	}
+}
+
+// readAccessLog returns the last lines of the current file of a route, containing search if set
+func readAccessLog(routeName string, lines int, search string) ([]string, error) {
+	file, err := os.Open(getAccessLogPath(routeName))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	search = strings.ToLower(search)
+	result := make([]string, 0, lines)
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64 * 1024), 1024 * 1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if search != "" && !strings.Contains(strings.ToLower(line), search) {
+			continue
+		}
+
+		if len(result) == lines {
+			result = append(result[1:], line)
+		} else {
+			result = append(result, line)
+		}
+	}
+
+	return result, scanner.Err()
+}
+
+func API_GetAccessLogs(w http.ResponseWriter, req *http.Request) {
+	if utils.AdminOnly(w, req) != nil {
+		return
+	}
+
+	if(req.Method == "GET") {
+		routeName := mux.Vars(req)["route"]
+
+		lines, err := strconv.Atoi(req.URL.Query().Get("lines"))
+		if err != nil || lines <= 0 {
+			lines = 100
+		}
+		if lines > 5000 {
+			lines = 5000
+		}
+
+		format := utils.AccessLogFormatList["JSON"]
+		if route, ok := getLiveRoute(routeName); ok {
+			format = getAccessLogFormat(route)
+		}
+
+		result, err := readAccessLog(routeName, lines, req.URL.Query().Get("search"))
+		if os.IsNotExist(err) {
+			utils.Error("AccessLogs: No access log for route " + routeName, nil)
+			utils.HTTPError(w, "No access log for this route", http.StatusNotFound, "HTTP002")
+			return
+		} else if err != nil {
+			utils.Error("AccessLogs: Cannot read access log of route " + routeName, err)
+			utils.HTTPError(w, "Cannot read access log", http.StatusInternalServerError, "HTTP001")
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "OK",
+			"data": map[string]interface{}{
+				"route": routeName,
+				"format": format,
+				"lines": result,
+			},
+		})
+	} else {
+		utils.Error("AccessLogs: Method not allowed" + req.Method, nil)
+		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
+		return
+	}
+}
@@ -0,0 +1,157 @@
+package proxy
+
+import (
+	"net/http"
+	"encoding/json"
+	"strconv"
+
+	"github.com/aseracorp/resiOS/src/utils"
+)
+
+func API_GetRoutesStatus(w http.ResponseWriter, req *http.Request) {
+	if utils.AdminOnly(w, req) != nil {
+		return
+	}
+
+	if(req.Method == "GET") {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "OK",
+			"data": GetRoutesStatus(),
+		})
+	} else {
+		utils.Error("RoutesStatus: Method not allowed" + req.Method, nil)
+		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
+		return
+	}
+}
+
+type CachePurgeRequestJSON struct {
+	Route string `json:"route"`
+	Prefix string `json:"prefix"`
+}
+
+func API_RoutesCache(w http.ResponseWriter, req *http.Request) {
+	if utils.AdminOnly(w, req) != nil {
+		return
+	}
+
+	if(req.Method == "GET") {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "OK",
+			"data": GetCachesStatus(),
+		})
+	} else if(req.Method == "POST") {
+		var request CachePurgeRequestJSON
+		err := json.NewDecoder(req.Body).Decode(&request)
+		if err != nil {
+			utils.Error("RoutesCachePurge: Invalid User Request", err)
+			utils.HTTPError(w, "Invalid request", http.StatusBadRequest, "HTTP001")
+			return
+		}
+
+		purged := PurgeCache(request.Route, request.Prefix)
+
+		utils.Log("RoutesCachePurge: Purged " + strconv.Itoa(purged) + " cached responses")
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "OK",
+			"data": purged,
+		})
+	} else {
+		utils.Error("RoutesCache: Method not allowed" + req.Method, nil)
+		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
+		return
+	}
+}
+
+type MaintenanceRequestJSON struct {
+	// route name, or * for every route
+	Route string `json:"route" validate:"required"`
+	Enabled bool `json:"enabled"`
+	Message string `json:"message"`
+	RetryAfter int `json:"retryAfter"`
+}
+
+func API_RoutesMaintenance(w http.ResponseWriter, req *http.Request) {
+	if utils.AdminOnly(w, req) != nil {
+		return
+	}
+
+	if(req.Method == "GET") {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "OK",
+			"data": utils.GetMaintenanceStatus(),
+		})
+	} else if(req.Method == "POST") {
+		var request MaintenanceRequestJSON
+		err := json.NewDecoder(req.Body).Decode(&request)
+		if err != nil {
+			utils.Error("RoutesMaintenance: Invalid User Request", err)
+			utils.HTTPError(w, "Invalid request", http.StatusBadRequest, "HTTP001")
+			return
+		}
+
+		errV := utils.Validate.Struct(request)
+		if errV != nil {
+			utils.Error("RoutesMaintenance: Invalid User Request", errV)
+			utils.HTTPError(w, "Invalid request: " + errV.Error(), http.StatusBadRequest, "HTTP001")
+			return
+		}
+
+		if request.RetryAfter <= 0 {
+			request.RetryAfter = 300
+		}
+
+		utils.SetRouteMaintenance(request.Route, utils.MaintenanceState{
+			Enabled: request.Enabled,
+			Message: request.Message,
+			RetryAfter: request.RetryAfter,
+			Reason: "manual",
+		})
+
+		state := "disabled"
+		if request.Enabled {
+			state = "enabled"
+		}
+
+		utils.Log("RoutesMaintenance: maintenance " + state + " for route " + request.Route)
+
+		utils.TriggerEvent(
+			"cosmos.proxy.route.maintenance",
+			"Proxy Route " + request.Route + " maintenance " + state,
+			"info",
+			"route@" + request.Route,
+			map[string]interface{}{
+			"route": request.Route,
+			"enabled": request.Enabled,
+			"user": req.Header.Get("x-cosmos-user"),
+		})
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "OK",
+			"data": utils.GetMaintenanceStatus(),
+		})
+	} else {
+		utils.Error("RoutesMaintenance: Method not allowed" + req.Method, nil)
+		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
+		return
+	}
+}
+
+// API_GetDiscoveredRoutes lists the routes generated from container labels, they are read-only
+func API_GetDiscoveredRoutes(w http.ResponseWriter, req *http.Request) {
+	if utils.AdminOnly(w, req) != nil {
+		return
+	}
+
+	if(req.Method == "GET") {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "OK",
+			"data": utils.GetDiscoveredRoutes(),
+		})
+	} else {
+		utils.Error("DiscoveredRoutes: Method not allowed" + req.Method, nil)
+		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
+		return
+	}
+}
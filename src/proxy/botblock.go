@@ -31,6 +31,9 @@ func BotDetectionMiddleware(next http.Handler) http.Handler {
 		
 		if userAgent == "" {
 			go metrics.PushShieldMetrics("bots")
+			if info := getRouteRequestInfo(r); info != nil {
+				info.SetShield("bot")
+			}
 			http.Error(w, "Access denied: Bots are not allowed.", http.StatusForbidden)
 			return
 		}
@@ -38,6 +41,9 @@ func BotDetectionMiddleware(next http.Handler) http.Handler {
 		for _, botUserAgent := range botUserAgents {
 			if userAgent == botUserAgent {
 			go metrics.PushShieldMetrics("bots")
+				if info := getRouteRequestInfo(r); info != nil {
+					info.SetShield("bot")
+				}
 				http.Error(w, "Access denied: Bots are not allowed.", http.StatusForbidden)
 				return
 			}
@@ -8,6 +8,8 @@ import (
 )
 
 func BuildFromConfig(router *mux.Router, config utils.ProxyConfig) *mux.Router {
+	ResetLoadBalancers()
+	ResetCaches()
 
 	router.HandleFunc("/_health", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
@@ -53,10 +55,42 @@ func BuildFromConfig(router *mux.Router, config utils.ProxyConfig) *mux.Router {
 
 	for i := len(config.Routes)-1; i >= 0; i-- {
 		routeConfig := config.Routes[i]
-		if !routeConfig.Disabled {
+		// passthrough routes never reach the HTTP server, see SNIListener
+		if !routeConfig.Disabled && !routeConfig.TLSPassthrough {
 			RouterGen(routeConfig, router, RouteTo(routeConfig))
 		}
 	}
+
+	// routes from container labels come after the configured ones, which take precedence
+	configuredNames := map[string]bool{}
+	for _, routeConfig := range config.Routes {
+		configuredNames[routeConfig.Name] = true
+	}
+	for _, routeConfig := range utils.GetDiscoveredRoutes() {
+		if configuredNames[routeConfig.Name] {
+			utils.Warn("Discovered route " + routeConfig.Name + " has the same name as a configured route, ignoring")
+			continue
+		}
+		if routeConfig.TLSPassthrough {
+			continue
+		}
+		RouterGen(routeConfig, router, RouteTo(routeConfig))
+	}
 	
 	return router
-}
\ No newline at end of file
+}
+
+// getLiveRoute finds a route served by the router by name, the configured ones before the discovered ones
+func getLiveRoute(name string) (utils.ProxyRouteConfig, bool) {
+	for _, route := range utils.GetMainConfig().HTTPConfig.ProxyConfig.Routes {
+		if route.Name == name {
+			return route, true
+		}
+	}
+	for _, route := range utils.GetDiscoveredRoutes() {
+		if route.Name == name {
+			return route, true
+		}
+	}
+	return utils.ProxyRouteConfig{}, false
+}
@@ -0,0 +1,753 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aseracorp/resiOS/src/utils"
+	"github.com/aseracorp/resiOS/src/metrics"
+)
+
+var cacheableStatus = map[int]bool{
+	200: true,
+	203: true,
+	204: true,
+	301: true,
+	308: true,
+	404: true,
+	410: true,
+}
+
+type cacheEntry struct {
+	key string
+	url string
+	path string
+	status int
+	header http.Header
+	body []byte
+	size int64
+	onDisk bool
+	storedAt time.Time
+	expires time.Time
+	staleUntil time.Time
+	etag string
+	lastModified string
+}
+
+type routeCache struct {
+	sync.Mutex
+	route utils.ProxyRouteConfig
+	config utils.ProxyCacheConfig
+	folder string
+	entries map[string]*list.Element
+	lru *list.List
+	varies map[string][]string
+	revalidating map[string]bool
+	memBytes int64
+	diskBytes int64
+	hits int64
+	misses int64
+}
+
+type RouteCacheStatus struct {
+	Route string `json:"route"`
+	Entries int `json:"entries"`
+	MemoryBytes int64 `json:"memoryBytes"`
+	DiskBytes int64 `json:"diskBytes"`
+	Hits int64 `json:"hits"`
+	Misses int64 `json:"misses"`
+	HitRatio float64 `json:"hitRatio"`
+}
+
+var routeCaches = map[string]*routeCache{}
+var routeCachesLock sync.Mutex
+
+func getCacheFolder(routeName string) string {
+	hash := sha256.Sum256([]byte(routeName))
+	return utils.CONFIGFOLDER + "cache/" + hex.EncodeToString(hash[:8]) + "/"
+}
+
+func newRouteCache(route utils.ProxyRouteConfig) *routeCache {
+	config := route.Cache
+
+	if config.MaxMemoryBytes <= 0 {
+		config.MaxMemoryBytes = 64 * 1024 * 1024 // 64MB
+	}
+	if config.MaxObjectBytes <= 0 {
+		config.MaxObjectBytes = 8 * 1024 * 1024 // 8MB
+	}
+	if config.MaxDiskBytes <= 0 {
+		config.MaxDiskBytes = 1024 * 1024 * 1024 // 1GB
+	}
+
+	cache := &routeCache{
+		route: route,
+		config: config,
+		folder: getCacheFolder(route.Name),
+		entries: map[string]*list.Element{},
+		lru: list.New(),
+		varies: map[string][]string{},
+		revalidating: map[string]bool{},
+	}
+
+	// the index lives in memory, start from a clean folder
+	os.RemoveAll(cache.folder)
+	if config.UseDisk {
+		if err := os.MkdirAll(cache.folder, 0750); err != nil {
+			utils.Error("Cache: cannot create cache folder for route " + route.Name + ", disk cache disabled", err)
+			cache.config.UseDisk = false
+		}
+	}
+
+	routeCachesLock.Lock()
+	routeCaches[route.Name] = cache
+	routeCachesLock.Unlock()
+
+	return cache
+}
+
+func ResetCaches() {
+	routeCachesLock.Lock()
+	defer routeCachesLock.Unlock()
+
+	for _, cache := range routeCaches {
+		os.RemoveAll(cache.folder)
+	}
+
+	routeCaches = map[string]*routeCache{}
+}
+
+type cacheControl map[string]string
+
+func parseCacheControl(value string) cacheControl {
+	cc := cacheControl{}
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		kv := strings.SplitN(part, "=", 2)
+		key := strings.ToLower(strings.TrimSpace(kv[0]))
+		if len(kv) == 2 {
+			cc[key] = strings.Trim(strings.TrimSpace(kv[1]), "\"")
+		} else {
+			cc[key] = ""
+		}
+	}
+	return cc
+}
+
+func (cc cacheControl) has(directive string) bool {
+	_, ok := cc[directive]
+	return ok
+}
+
+func (cc cacheControl) seconds(directive string) (int, bool) {
+	value, ok := cc[directive]
+	if !ok {
+		return 0, false
+	}
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds < 0 {
+		return 0, false
+	}
+	return seconds, true
+}
+
+// getBaseCacheKey separates the users, the backend can answer differently to each of them
+func getBaseCacheKey(r *http.Request) string {
+	key := r.Host + r.URL.RequestURI()
+	if user := r.Header.Get("x-cosmos-user"); user != "" {
+		key += "\nx-cosmos-user:" + user
+	}
+	return key
+}
+
+// hasCredentials tells if the request carries credentials the cache cannot tell apart
+func hasCredentials(r *http.Request) bool {
+	if r.Header.Get("Authorization") != "" {
+		return true
+	}
+	_, err := r.Cookie("jwttoken")
+	return err == nil
+}
+
+func getVariantKey(baseKey string, varyHeaders []string, r *http.Request) string {
+	if len(varyHeaders) == 0 {
+		return baseKey
+	}
+
+	key := baseKey
+	for _, name := range varyHeaders {
+		key += "\n" + name + ":" + r.Header.Get(name)
+	}
+	return key
+}
+
+// lookup returns the entry matching the request, and its body
+func (cache *routeCache) lookup(r *http.Request) (*cacheEntry, []byte) {
+	cache.Lock()
+	defer cache.Unlock()
+
+	baseKey := getBaseCacheKey(r)
+	key := getVariantKey(baseKey, cache.varies[baseKey], r)
+
+	element, ok := cache.entries[key]
+	if !ok {
+		return nil, nil
+	}
+
+	cache.lru.MoveToFront(element)
+	entry := element.Value.(*cacheEntry)
+
+	// work on a copy, the stored entry can be refreshed concurrently
+	copied := *entry
+
+	if !entry.onDisk {
+		return &copied, entry.body
+	}
+
+	body, err := os.ReadFile(cache.folder + cache.fileName(entry.key))
+	if err != nil {
+		utils.Error("Cache: cannot read cached file for " + entry.url, err)
+		cache.removeElement(element)
+		return nil, nil
+	}
+
+	return &copied, body
+}
+
+func (cache *routeCache) fileName(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:])
+}
+
+func (cache *routeCache) removeElement(element *list.Element) {
+	entry := element.Value.(*cacheEntry)
+	if entry.onDisk {
+		os.Remove(cache.folder + cache.fileName(entry.key))
+		cache.diskBytes -= entry.size
+	} else {
+		cache.memBytes -= entry.size
+	}
+	cache.lru.Remove(element)
+	delete(cache.entries, entry.key)
+}
+
+// evict moves the least recently used entries to disk, or drops them, until under the caps
+func (cache *routeCache) evict() {
+	for element := cache.lru.Back(); element != nil && cache.memBytes > cache.config.MaxMemoryBytes; {
+		prev := element.Prev()
+		entry := element.Value.(*cacheEntry)
+
+		if !entry.onDisk {
+			spilled := false
+			if cache.config.UseDisk {
+				err := os.WriteFile(cache.folder + cache.fileName(entry.key), entry.body, 0640)
+				if err != nil {
+					utils.Error("Cache: cannot write cache file for " + entry.url, err)
+				} else {
+					cache.memBytes -= entry.size
+					cache.diskBytes += entry.size
+					entry.onDisk = true
+					entry.body = nil
+					spilled = true
+				}
+			}
+
+			if !spilled {
+				cache.removeElement(element)
+			}
+		}
+
+		element = prev
+	}
+
+	for element := cache.lru.Back(); element != nil && cache.diskBytes > cache.config.MaxDiskBytes; {
+		prev := element.Prev()
+		if element.Value.(*cacheEntry).onDisk {
+			cache.removeElement(element)
+		}
+		element = prev
+	}
+}
+
+// store saves a response if the headers allow it
+func (cache *routeCache) store(r *http.Request, status int, header http.Header, body []byte) {
+	if !cacheableStatus[status] || header.Get("Set-Cookie") != "" {
+		return
+	}
+
+	cc := parseCacheControl(header.Get("Cache-Control"))
+	if cc.has("no-store") || cc.has("private") {
+		return
+	}
+
+	// the responses to authenticated requests are only shared when the backend says so
+	if hasCredentials(r) && !cc.has("public") {
+		return
+	}
+
+	vary := header.Get("Vary")
+	if strings.TrimSpace(vary) == "*" {
+		return
+	}
+
+	now := time.Now()
+	ttl := -1
+	if seconds, ok := cc.seconds("s-maxage"); ok {
+		ttl = seconds
+	} else if seconds, ok := cc.seconds("max-age"); ok {
+		ttl = seconds
+	} else if expires := header.Get("Expires"); expires != "" {
+		if date, err := http.ParseTime(expires); err == nil {
+			ttl = int(date.Sub(now).Seconds())
+			if ttl < 0 {
+				ttl = 0
+			}
+		} else {
+			ttl = 0
+		}
+	} else if cache.config.DefaultTTL > 0 {
+		ttl = cache.config.DefaultTTL
+	}
+
+	if cc.has("no-cache") {
+		ttl = 0
+	}
+
+	if ttl < 0 {
+		return
+	}
+
+	etag := header.Get("ETag")
+	lastModified := header.Get("Last-Modified")
+
+	// a response that is immediately stale is only useful if it can be revalidated
+	if ttl == 0 && etag == "" && lastModified == "" {
+		return
+	}
+
+	staleWhileRevalidate, _ := cc.seconds("stale-while-revalidate")
+	if cc.has("must-revalidate") || cc.has("proxy-revalidate") {
+		staleWhileRevalidate = 0
+	}
+
+	varyHeaders := []string{}
+	for _, name := range strings.Split(vary, ",") {
+		name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+		if name != "" {
+			varyHeaders = append(varyHeaders, name)
+		}
+	}
+	sort.Strings(varyHeaders)
+
+	storedHeader := header.Clone()
+	storedHeader.Del("X-Cache")
+	storedHeader.Del("Age")
+
+	baseKey := getBaseCacheKey(r)
+	key := getVariantKey(baseKey, varyHeaders, r)
+	expires := now.Add(time.Duration(ttl) * time.Second)
+
+	entry := &cacheEntry{
+		key: key,
+		url: baseKey,
+		path: r.URL.Path,
+		status: status,
+		header: storedHeader,
+		body: body,
+		size: int64(len(body)),
+		storedAt: now,
+		expires: expires,
+		staleUntil: expires.Add(time.Duration(staleWhileRevalidate) * time.Second),
+		etag: etag,
+		lastModified: lastModified,
+	}
+
+	cache.Lock()
+	defer cache.Unlock()
+
+	cache.varies[baseKey] = varyHeaders
+
+	if element, ok := cache.entries[key]; ok {
+		cache.removeElement(element)
+	}
+
+	cache.entries[key] = cache.lru.PushFront(entry)
+	cache.memBytes += entry.size
+
+	cache.evict()
+}
+
+// refresh extends the freshness of an entry after a 304 from the backend
+func (cache *routeCache) refresh(key string, header http.Header) {
+	cache.Lock()
+	defer cache.Unlock()
+
+	element, ok := cache.entries[key]
+	if !ok {
+		return
+	}
+	entry := element.Value.(*cacheEntry)
+
+	cc := parseCacheControl(header.Get("Cache-Control"))
+	ttl := int(entry.expires.Sub(entry.storedAt).Seconds())
+	if seconds, ok := cc.seconds("s-maxage"); ok {
+		ttl = seconds
+	} else if seconds, ok := cc.seconds("max-age"); ok {
+		ttl = seconds
+	}
+	swr := entry.staleUntil.Sub(entry.expires)
+
+	entry.storedAt = time.Now()
+	entry.expires = entry.storedAt.Add(time.Duration(ttl) * time.Second)
+	entry.staleUntil = entry.expires.Add(swr)
+}
+
+func (cache *routeCache) Purge(prefix string) int {
+	cache.Lock()
+	defer cache.Unlock()
+
+	purged := 0
+	for _, element := range cache.entries {
+		entry := element.Value.(*cacheEntry)
+		if prefix == "" || strings.HasPrefix(entry.url, prefix) || strings.HasPrefix(entry.path, prefix) {
+			cache.removeElement(element)
+			purged++
+		}
+	}
+
+	if prefix == "" {
+		cache.varies = map[string][]string{}
+	}
+
+	return purged
+}
+
+func (cache *routeCache) Status() RouteCacheStatus {
+	cache.Lock()
+	defer cache.Unlock()
+
+	ratio := 0.0
+	if cache.hits + cache.misses > 0 {
+		ratio = float64(cache.hits) / float64(cache.hits + cache.misses)
+	}
+
+	return RouteCacheStatus{
+		Route: cache.route.Name,
+		Entries: len(cache.entries),
+		MemoryBytes: cache.memBytes,
+		DiskBytes: cache.diskBytes,
+		Hits: cache.hits,
+		Misses: cache.misses,
+		HitRatio: ratio,
+	}
+}
+
+func (cache *routeCache) countResult(hit bool) {
+	cache.Lock()
+	result := "miss"
+	label := "Cache Misses "
+	if hit {
+		cache.hits++
+		result = "hit"
+		label = "Cache Hits "
+	} else {
+		cache.misses++
+	}
+	cache.Unlock()
+
+	metrics.PushSetMetric("proxy.route.cache." + result + "." + cache.route.Name, 1, metrics.DataDef{
+		Max: 0,
+		Period: time.Second * 30,
+		Label: label + cache.route.Name,
+		AggloType: "sum",
+		SetOperation: "sum",
+		Object: "route@" + cache.route.Name,
+	})
+}
+
+// PurgeCache purges the cache of a route, or of all routes if routeName is empty, optionally only the URLs starting with prefix
+func PurgeCache(routeName string, prefix string) int {
+	routeCachesLock.Lock()
+	defer routeCachesLock.Unlock()
+
+	purged := 0
+	for name, cache := range routeCaches {
+		if routeName == "" || routeName == name {
+			purged += cache.Purge(prefix)
+		}
+	}
+
+	return purged
+}
+
+func GetCachesStatus() map[string]RouteCacheStatus {
+	routeCachesLock.Lock()
+	defer routeCachesLock.Unlock()
+
+	result := map[string]RouteCacheStatus{}
+	for name, cache := range routeCaches {
+		result[name] = cache.Status()
+	}
+
+	return result
+}
+
+// cacheWriter forwards the response to the client while keeping a copy to be cached
+type cacheWriter struct {
+	http.ResponseWriter
+	status int
+	wroteHeader bool
+	header http.Header
+	buffer bytes.Buffer
+	overflow bool
+	maxSize int64
+	revalidating bool
+	notModified bool
+}
+
+func (w *cacheWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	w.status = status
+
+	// the outer middlewares can still change the headers, like the compression, keep them as the backend sent them
+	w.header = w.Header().Clone()
+
+	// the backend confirmed our cached copy, it will be served instead
+	if w.revalidating && status == http.StatusNotModified {
+		w.notModified = true
+		return
+	}
+
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *cacheWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	if w.notModified {
+		return len(p), nil
+	}
+
+	if !w.overflow {
+		if int64(w.buffer.Len() + len(p)) > w.maxSize {
+			w.overflow = true
+			w.buffer = bytes.Buffer{}
+		} else {
+			w.buffer.Write(p)
+		}
+	}
+
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *cacheWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *cacheWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	w.overflow = true
+	return hijacker.Hijack()
+}
+
+// discardResponseWriter is used to revalidate entries in the background
+type discardResponseWriter struct {
+	header http.Header
+}
+
+func (w *discardResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *discardResponseWriter) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (w *discardResponseWriter) WriteHeader(status int) {}
+
+func serveCacheEntry(w http.ResponseWriter, r *http.Request, entry *cacheEntry, body []byte, cacheStatus string) {
+	header := w.Header()
+	for name, values := range entry.header {
+		header[name] = values
+	}
+	header.Set("Age", strconv.Itoa(int(time.Since(entry.storedAt).Seconds())))
+	header.Set("X-Cache", cacheStatus)
+
+	notModified := false
+	if inm := r.Header.Get("If-None-Match"); inm != "" && entry.etag != "" {
+		for _, tag := range strings.Split(inm, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag == "*" || strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(entry.etag, "W/") {
+				notModified = true
+			}
+		}
+	} else if ims := r.Header.Get("If-Modified-Since"); ims != "" && entry.lastModified != "" {
+		since, err1 := http.ParseTime(ims)
+		modified, err2 := http.ParseTime(entry.lastModified)
+		if err1 == nil && err2 == nil && !modified.After(since) {
+			notModified = true
+		}
+	}
+
+	if notModified && entry.status == http.StatusOK {
+		header.Del("Content-Length")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	header.Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(entry.status)
+
+	if r.Method != "HEAD" {
+		w.Write(body)
+	}
+}
+
+func (cache *routeCache) revalidateInBackground(next http.Handler, r *http.Request, entry *cacheEntry) {
+	cache.Lock()
+	if cache.revalidating[entry.key] {
+		cache.Unlock()
+		return
+	}
+	cache.revalidating[entry.key] = true
+	cache.Unlock()
+
+	req := r.Clone(context.Background())
+	req.Method = "GET"
+	req.Header.Del("If-Modified-Since")
+	req.Header.Del("If-None-Match")
+	if entry.etag != "" {
+		req.Header.Set("If-None-Match", entry.etag)
+	} else if entry.lastModified != "" {
+		req.Header.Set("If-Modified-Since", entry.lastModified)
+	}
+
+	go func() {
+		defer func() {
+			cache.Lock()
+			delete(cache.revalidating, entry.key)
+			cache.Unlock()
+		}()
+
+		writer := &cacheWriter{
+			ResponseWriter: &discardResponseWriter{header: http.Header{}},
+			maxSize: cache.config.MaxObjectBytes,
+			revalidating: true,
+		}
+
+		next.ServeHTTP(writer, req)
+
+		if writer.notModified {
+			cache.refresh(entry.key, writer.Header())
+		} else if !writer.overflow {
+			cache.store(req, writer.status, writer.Header(), writer.buffer.Bytes())
+		}
+
+		utils.Debug("Cache: revalidated " + entry.url + " in background")
+	}()
+}
+
+func CacheMiddleware(route utils.ProxyRouteConfig) func(http.Handler) http.Handler {
+	cache := newRouteCache(route)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if (r.Method != "GET" && r.Method != "HEAD") || r.Header.Get("Upgrade") != "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			requestCC := parseCacheControl(r.Header.Get("Cache-Control"))
+			if requestCC.has("no-store") {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			bypass := requestCC.has("no-cache") || r.Header.Get("Pragma") == "no-cache"
+
+			var entry *cacheEntry
+			var body []byte
+			if !bypass {
+				entry, body = cache.lookup(r)
+			}
+
+			now := time.Now()
+
+			if entry != nil && now.Before(entry.expires) {
+				cache.countResult(true)
+				serveCacheEntry(w, r, entry, body, "HIT")
+				return
+			}
+
+			if entry != nil && now.Before(entry.staleUntil) {
+				cache.countResult(true)
+				cache.revalidateInBackground(next, r, entry)
+				serveCacheEntry(w, r, entry, body, "STALE")
+				return
+			}
+
+			cache.countResult(false)
+
+			writer := &cacheWriter{
+				ResponseWriter: w,
+				maxSize: cache.config.MaxObjectBytes,
+			}
+
+			req := r
+			clientConditional := r.Header.Get("If-None-Match") != "" || r.Header.Get("If-Modified-Since") != ""
+
+			// ask the backend to confirm our stale copy instead of sending the whole body
+			if entry != nil && !clientConditional && r.Method == "GET" && (entry.etag != "" || entry.lastModified != "") {
+				req = r.Clone(r.Context())
+				if entry.etag != "" {
+					req.Header.Set("If-None-Match", entry.etag)
+				} else {
+					req.Header.Set("If-Modified-Since", entry.lastModified)
+				}
+				writer.revalidating = true
+			}
+
+			if !clientConditional && r.Method == "GET" {
+				w.Header().Set("X-Cache", "MISS")
+			}
+
+			next.ServeHTTP(writer, req)
+
+			if writer.notModified {
+				cache.refresh(entry.key, writer.header)
+				entry.storedAt = time.Now()
+				serveCacheEntry(w, r, entry, body, "REVALIDATED")
+				return
+			}
+
+			if r.Method == "GET" && !clientConditional && !writer.overflow && writer.wroteHeader {
+				cache.store(r, writer.status, writer.header, writer.buffer.Bytes())
+			}
+		})
+	}
+}
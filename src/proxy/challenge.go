@@ -0,0 +1,439 @@
+package proxy
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash/fnv"
+	"html/template"
+	"math/bits"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aseracorp/resiOS/src/metrics"
+	"github.com/aseracorp/resiOS/src/utils"
+)
+
+// the solution is posted back to the page it was asked from, with this query parameter
+const challengeParam = "cosmos-challenge"
+
+// time to solve a challenge once it is served
+const challengeValidity = 5 * time.Minute
+
+// the proof of work runs in plain JavaScript, harder ones would take too long on phones
+const challengeMaxDifficulty = 24
+
+// used if the auth key is missing, the passes are then lost on restart
+var challengeFallbackKey = func() []byte {
+	key := make([]byte, 32)
+	rand.Read(key)
+	return key
+}()
+
+func getChallengeKey() []byte {
+	authKey := utils.GetMainConfig().HTTPConfig.AuthPrivateKey
+	if authKey == "" {
+		return challengeFallbackKey
+	}
+	key := sha256.Sum256([]byte("cosmos-challenge\x00" + authKey))
+	return key[:]
+}
+
+func challengeSign(parts ...string) string {
+	mac := hmac.New(sha256.New, getChallengeKey())
+	mac.Write([]byte(strings.Join(parts, "\x00")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func challengeCookieName(route utils.ProxyRouteConfig) string {
+	hash := fnv.New32a()
+	hash.Write([]byte(route.Name))
+	return fmt.Sprintf("cosmos-challenge-%08x", hash.Sum32())
+}
+
+func getChallengeDifficulty(config utils.ProxyChallengeConfig) int {
+	if config.Difficulty <= 0 {
+		return 16
+	}
+	if config.Difficulty > challengeMaxDifficulty {
+		return challengeMaxDifficulty
+	}
+	return config.Difficulty
+}
+
+// newChallenge is stateless, it is signed for the route and the client: expiry.random.signature
+func newChallenge(route utils.ProxyRouteConfig, clientID string) string {
+	random := make([]byte, 16)
+	rand.Read(random)
+
+	expiry := strconv.FormatInt(time.Now().Add(challengeValidity).Unix(), 10)
+	salt := hex.EncodeToString(random)
+
+	return expiry + "." + salt + "." + challengeSign("challenge", route.Name, clientID, expiry, salt)
+}
+
+func leadingZeroBits(hash []byte) int {
+	count := 0
+	for _, b := range hash {
+		count += bits.LeadingZeros8(b)
+		if b != 0 {
+			break
+		}
+	}
+	return count
+}
+
+// the challenges already solved, until they expire, so each one only gives one pass
+var usedChallenges = map[string]int64{}
+var usedChallengesLock sync.Mutex
+
+// useChallenge returns false if the challenge was already used
+func useChallenge(signature string, expiry int64) bool {
+	usedChallengesLock.Lock()
+	defer usedChallengesLock.Unlock()
+
+	now := time.Now().Unix()
+
+	if len(usedChallenges) > 1000 {
+		for key, keyExpiry := range usedChallenges {
+			if now > keyExpiry {
+				delete(usedChallenges, key)
+			}
+		}
+	}
+
+	if _, ok := usedChallenges[signature]; ok {
+		return false
+	}
+
+	usedChallenges[signature] = expiry
+	return true
+}
+
+func verifyChallenge(route utils.ProxyRouteConfig, clientID string, challenge string, nonce string, difficulty int) bool {
+	parts := strings.Split(challenge, ".")
+	if len(parts) != 3 || len(nonce) == 0 || len(nonce) > 20 {
+		return false
+	}
+
+	if !hmac.Equal([]byte(parts[2]), []byte(challengeSign("challenge", route.Name, clientID, parts[0], parts[1]))) {
+		return false
+	}
+
+	expiry, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || time.Now().Unix() > expiry {
+		return false
+	}
+
+	hash := sha256.Sum256([]byte(challenge + ":" + nonce))
+	if leadingZeroBits(hash[:]) < difficulty {
+		return false
+	}
+
+	return useChallenge(parts[2], expiry)
+}
+
+// hasChallengePass checks the cookie given once the challenge is solved: expiry.signature
+func hasChallengePass(r *http.Request, route utils.ProxyRouteConfig, clientID string) bool {
+	cookie, err := r.Cookie(challengeCookieName(route))
+	if err != nil {
+		return false
+	}
+
+	expiry, signature, ok := strings.Cut(cookie.Value, ".")
+	if !ok {
+		return false
+	}
+
+	if !hmac.Equal([]byte(signature), []byte(challengeSign("pass", route.Name, clientID, r.UserAgent(), expiry))) {
+		return false
+	}
+
+	expiryTime, err := strconv.ParseInt(expiry, 10, 64)
+	return err == nil && time.Now().Unix() <= expiryTime
+}
+
+// isSuspectedClient is a client the shield already caught, or one without a browser like user agent
+func isSuspectedClient(r *http.Request, clientID string) bool {
+	if utils.GetIPAbuseCounter(clientID) > 0 {
+		return true
+	}
+
+	if lastBan := GetLastBan(clientID, true); lastBan != nil && time.Since(lastBan.Time) < 24 * time.Hour {
+		return true
+	}
+
+	userAgent := strings.ToLower(r.UserAgent())
+	if userAgent == "" {
+		return true
+	}
+	for _, botUserAgent := range botUserAgents {
+		if strings.Contains(userAgent, strings.ToLower(botUserAgent)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func pushChallengeMetrics(route utils.ProxyRouteConfig, result string) {
+	if utils.GetMainConfig().MonitoringDisabled {
+		return
+	}
+
+	labels := map[string]string{
+		"issued": "Challenges Issued ",
+		"solved": "Challenges Solved ",
+		"failed": "Challenges Failed ",
+	}
+
+	metrics.PushSetMetric("proxy.challenge." + result + "." + route.Name, 1, metrics.DataDef{
+		Max: 0,
+		Period: time.Second * 30,
+		Label: labels[result] + route.Name,
+		AggloType: "sum",
+		SetOperation: "sum",
+		Object: "route@" + route.Name,
+	})
+}
+
+type challengePageData struct {
+	Challenge string
+	Difficulty int
+	Action string
+	Redirect string
+}
+
+var challengePage = template.Must(template.New("challenge").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta name="robots" content="noindex">
+<title>Checking your browser</title>
+<style>
+body { font-family: sans-serif; background: #1a1a1a; color: #ddd; display: flex; align-items: center; justify-content: center; height: 100vh; margin: 0; }
+main { text-align: center; max-width: 28em; padding: 1em; }
+</style>
+</head>
+<body>
+<main>
+<h1>Checking your browser</h1>
+<p id="status">This only takes a few seconds.</p>
+<noscript><p>Please enable JavaScript to continue.</p></noscript>
+<form id="form" method="POST" action="{{.Action}}">
+<input type="hidden" name="challenge" value="{{.Challenge}}">
+<input type="hidden" name="nonce" id="nonce">
+<input type="hidden" name="redirect" value="{{.Redirect}}">
+</form>
+</main>
+<script>
+(function() {
+	var challenge = {{.Challenge}};
+	var difficulty = {{.Difficulty}};
+
+	function sha256(ascii) {
+		function rightRotate(value, amount) { return (value >>> amount) | (value << (32 - amount)); }
+		var maxWord = Math.pow(2, 32), words = [], bitLength = ascii.length * 8, i, j;
+		var hash = sha256.h = sha256.h || [], k = sha256.k = sha256.k || [];
+		var primeCounter = k.length, isComposite = {};
+		for (var candidate = 2; primeCounter < 64; candidate++) {
+			if (!isComposite[candidate]) {
+				for (i = 0; i < 313; i += candidate) { isComposite[i] = candidate; }
+				hash[primeCounter] = (Math.pow(candidate, .5) * maxWord) | 0;
+				k[primeCounter++] = (Math.pow(candidate, 1 / 3) * maxWord) | 0;
+			}
+		}
+		ascii += '\x80';
+		while (ascii.length % 64 - 56) { ascii += '\x00'; }
+		for (i = 0; i < ascii.length; i++) {
+			words[i >> 2] |= ascii.charCodeAt(i) << ((3 - i) % 4) * 8;
+		}
+		words[words.length] = (bitLength / maxWord) | 0;
+		words[words.length] = bitLength;
+		for (j = 0; j < words.length;) {
+			var w = words.slice(j, j += 16), oldHash = hash;
+			hash = hash.slice(0, 8);
+			for (i = 0; i < 64; i++) {
+				var w15 = w[i - 15], w2 = w[i - 2], a = hash[0], e = hash[4];
+				var temp1 = hash[7] + (rightRotate(e, 6) ^ rightRotate(e, 11) ^ rightRotate(e, 25)) + ((e & hash[5]) ^ ((~e) & hash[6])) + k[i]
+					+ (w[i] = (i < 16) ? w[i] : (w[i - 16] + (rightRotate(w15, 7) ^ rightRotate(w15, 18) ^ (w15 >>> 3)) + w[i - 7] + (rightRotate(w2, 17) ^ rightRotate(w2, 19) ^ (w2 >>> 10))) | 0);
+				var temp2 = (rightRotate(a, 2) ^ rightRotate(a, 13) ^ rightRotate(a, 22)) + ((a & hash[1]) ^ (a & hash[2]) ^ (hash[1] & hash[2]));
+				hash = [(temp1 + temp2) | 0].concat(hash);
+				hash[4] = (hash[4] + temp1) | 0;
+			}
+			for (i = 0; i < 8; i++) { hash[i] = (hash[i] + oldHash[i]) | 0; }
+		}
+		return hash.slice(0, 8);
+	}
+
+	function zeroBits(hash) {
+		var count = 0;
+		for (var i = 0; i < hash.length; i++) {
+			if (hash[i] === 0) { count += 32; continue; }
+			return count + Math.clz32(hash[i]);
+		}
+		return count;
+	}
+
+	var nonce = 0;
+	function work() {
+		var end = Date.now() + 50;
+		while (Date.now() < end) {
+			if (zeroBits(sha256(challenge + ':' + nonce)) >= difficulty) {
+				document.getElementById('nonce').value = nonce;
+				document.getElementById('status').textContent = 'Done, redirecting...';
+				document.getElementById('form').submit();
+				return;
+			}
+			nonce++;
+		}
+		setTimeout(work, 0);
+	}
+	work();
+})();
+</script>
+</body>
+</html>
+`))
+
+func serveChallenge(w http.ResponseWriter, r *http.Request, route utils.ProxyRouteConfig, clientID string, status int) {
+	if info := getRouteRequestInfo(r); info != nil {
+		info.SetShield("challenge")
+	}
+
+	go pushChallengeMetrics(route, "issued")
+
+	header := w.Header()
+	header.Set("Cache-Control", "no-store")
+
+	if !acceptsHTML(r) {
+		http.Error(w, "Access denied: this route requires a browser challenge.", status)
+		return
+	}
+
+	redirect := r.URL.EscapedPath()
+	if r.Method == "GET" || r.Method == "HEAD" {
+		redirect = r.URL.RequestURI()
+	}
+
+	header.Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+
+	err := challengePage.Execute(w, challengePageData{
+		Challenge: newChallenge(route, clientID),
+		Difficulty: getChallengeDifficulty(route.Challenge),
+		Action: r.URL.EscapedPath() + "?" + challengeParam + "=1",
+		Redirect: redirect,
+	})
+	if err != nil {
+		utils.Error("Challenge: cannot render the challenge of route " + route.Name, err)
+	}
+}
+
+// isSafeRedirect only lets the challenge send back to a path of the same host
+func isSafeRedirect(redirect string) bool {
+	return strings.HasPrefix(redirect, "/") && !strings.HasPrefix(redirect, "//") && !strings.HasPrefix(redirect, "/\\")
+}
+
+// getChallengeSolution reads the form posted by the challenge page, the body is left intact for the other forms
+func getChallengeSolution(r *http.Request) (url.Values, bool) {
+	if r.Method != "POST" || r.URL.Query().Get(challengeParam) == "" {
+		return nil, false
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "application/x-www-form-urlencoded" {
+		return nil, false
+	}
+
+	body, complete := peekRequestBody(r, 4096)
+	if !complete {
+		return nil, false
+	}
+
+	form, err := url.ParseQuery(string(body))
+	if err != nil || form.Get("challenge") == "" || form.Get("nonce") == "" {
+		return nil, false
+	}
+
+	return form, true
+}
+
+func solveChallenge(w http.ResponseWriter, r *http.Request, route utils.ProxyRouteConfig, clientID string, form url.Values) {
+	if !verifyChallenge(route, clientID, form.Get("challenge"), form.Get("nonce"), getChallengeDifficulty(route.Challenge)) {
+		utils.Warn("Challenge: wrong or expired solution from " + clientID + " on route " + route.Name)
+		go pushChallengeMetrics(route, "failed")
+		utils.IncrementIPAbuseCounter(clientID)
+		serveChallenge(w, r, route, clientID, http.StatusForbidden)
+		return
+	}
+
+	duration := time.Duration(route.Challenge.Duration) * time.Minute
+	if duration <= 0 {
+		duration = time.Hour
+	}
+
+	expiry := strconv.FormatInt(time.Now().Add(duration).Unix(), 10)
+
+	http.SetCookie(w, &http.Cookie{
+		Name: challengeCookieName(route),
+		Value: expiry + "." + challengeSign("pass", route.Name, clientID, r.UserAgent(), expiry),
+		Path: "/",
+		MaxAge: int(duration.Seconds()),
+		HttpOnly: true,
+		Secure: r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	go pushChallengeMetrics(route, "solved")
+	utils.Debug("Challenge: " + clientID + " solved the challenge of route " + route.Name)
+
+	redirect := form.Get("redirect")
+	if !isSafeRedirect(redirect) {
+		redirect = "/"
+	}
+
+	http.Redirect(w, r, redirect, http.StatusSeeOther)
+}
+
+// ChallengeMiddleware asks for a proof of work in the browser, then lets the client through for a while with a signed cookie
+func ChallengeMiddleware(route utils.ProxyRouteConfig) func(next http.Handler) http.Handler {
+	challengeAll := strings.ToUpper(route.Challenge.Mode) == utils.ChallengeModeList["ALL"]
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			clientID := GetClientID(r, route)
+
+			// logged in users, through the auth middleware, and allowlisted clients are trusted
+			if r.Header.Get("x-cosmos-user") != "" || isShieldAllowlisted(clientID, route.SmartShield) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if hasChallengePass(r, route, clientID) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if form, ok := getChallengeSolution(r); ok {
+				solveChallenge(w, r, route, clientID, form)
+				return
+			}
+
+			if !challengeAll && !isSuspectedClient(r, clientID) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			serveChallenge(w, r, route, clientID, http.StatusForbidden)
+		})
+	}
+}
@@ -0,0 +1,343 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/aseracorp/resiOS/src/utils"
+)
+
+type compressionEncoder interface {
+	io.WriteCloser
+	Flush() error
+}
+
+var compressionEncoders = map[string]func(w io.Writer, level int) (compressionEncoder, error){
+	"zstd": func(w io.Writer, level int) (compressionEncoder, error) {
+		encoderLevel := zstd.SpeedDefault
+		if level > 0 {
+			encoderLevel = zstd.EncoderLevelFromZstd(level)
+		}
+		return zstd.NewWriter(w,
+			zstd.WithEncoderLevel(encoderLevel),
+			zstd.WithEncoderConcurrency(1),
+			zstd.WithLowerEncoderMem(true))
+	},
+	"br": func(w io.Writer, level int) (compressionEncoder, error) {
+		if level <= 0 || level > brotli.BestCompression {
+			level = brotli.DefaultCompression
+		}
+		return brotli.NewWriterLevel(w, level), nil
+	},
+	"gzip": func(w io.Writer, level int) (compressionEncoder, error) {
+		if level <= 0 || level > gzip.BestCompression {
+			level = gzip.DefaultCompression
+		}
+		return gzip.NewWriterLevel(w, level)
+	},
+}
+
+var defaultCompressibleTypes = []string{
+	"text/",
+	"application/json",
+	"application/javascript",
+	"application/x-javascript",
+	"application/xml",
+	"application/xhtml+xml",
+	"application/rss+xml",
+	"application/atom+xml",
+	"application/manifest+json",
+	"application/wasm",
+	"image/svg+xml",
+	"font/ttf",
+	"font/otf",
+}
+
+func getCompressionConfig(route utils.ProxyRouteConfig) utils.ProxyCompressionConfig {
+	config := route.Compression
+
+	algorithms := []string{}
+	for _, algorithm := range config.Algorithms {
+		algorithm = strings.ToLower(strings.TrimSpace(algorithm))
+		if _, ok := compressionEncoders[algorithm]; ok {
+			algorithms = append(algorithms, algorithm)
+		} else {
+			utils.Warn("Compression: unsupported algorithm " + algorithm + " on route " + route.Name + ", ignoring it")
+		}
+	}
+	if len(algorithms) == 0 {
+		algorithms = []string{"zstd", "br", "gzip"}
+	}
+	config.Algorithms = algorithms
+
+	if len(config.ContentTypes) == 0 {
+		config.ContentTypes = defaultCompressibleTypes
+	}
+	if config.MinSize <= 0 {
+		config.MinSize = 1024
+	}
+
+	return config
+}
+
+// negotiateEncoding picks the first algorithm of the route accepted by the client
+func negotiateEncoding(acceptEncoding string, algorithms []string) string {
+	accepted := map[string]bool{}
+	wildcard := false
+
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		fields := strings.Split(strings.TrimSpace(part), ";")
+		name := strings.ToLower(strings.TrimSpace(fields[0]))
+		ok := true
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				q, err := strconv.ParseFloat(strings.TrimPrefix(param, "q="), 64)
+				ok = err == nil && q > 0
+			}
+		}
+		if name == "*" {
+			wildcard = ok
+		} else if name != "" {
+			accepted[name] = ok
+		}
+	}
+
+	for _, algorithm := range algorithms {
+		if ok, listed := accepted[algorithm]; (listed && ok) || (!listed && wildcard) {
+			return algorithm
+		}
+	}
+
+	return ""
+}
+
+// compressWriter buffers the beginning of the response until it knows if it is worth compressing
+type compressWriter struct {
+	http.ResponseWriter
+	config utils.ProxyCompressionConfig
+	encoding string
+	status int
+	wroteHeader bool
+	decided bool
+	encoder compressionEncoder
+	buffer bytes.Buffer
+	hijacked bool
+}
+
+func (w *compressWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	w.status = status
+
+	// nothing to compress, do not hold the headers back
+	if status < 200 || status == http.StatusNoContent || status == http.StatusNotModified || status == http.StatusPartialContent {
+		w.decided = true
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+
+	// the client does not accept any of the algorithms, the caches still have to know the response varies
+	if w.encoding == "" {
+		w.decided = true
+		w.addVary()
+		w.ResponseWriter.WriteHeader(status)
+	}
+}
+
+// isCompressible tells if the response could be compressed for a client accepting it
+func (w *compressWriter) isCompressible() bool {
+	header := w.Header()
+
+	if w.status != http.StatusOK || header.Get("Content-Encoding") != "" {
+		return false
+	}
+
+	contentType := strings.ToLower(header.Get("Content-Type"))
+	for _, allowed := range w.config.ContentTypes {
+		if strings.HasPrefix(contentType, strings.ToLower(allowed)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// addVary marks the compressible responses as depending on Accept-Encoding, compressed or not
+func (w *compressWriter) addVary() {
+	if !w.isCompressible() {
+		return
+	}
+
+	header := w.Header()
+	for _, value := range header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			name = strings.TrimSpace(name)
+			if name == "*" || strings.EqualFold(name, "Accept-Encoding") {
+				return
+			}
+		}
+	}
+	header.Add("Vary", "Accept-Encoding")
+}
+
+func (w *compressWriter) shouldCompress(knownSize int) bool {
+	header := w.Header()
+
+	if w.encoding == "" || !w.isCompressible() {
+		return false
+	}
+
+	if contentLength := header.Get("Content-Length"); contentLength != "" {
+		if size, err := strconv.Atoi(contentLength); err == nil {
+			knownSize = size
+		}
+	}
+
+	return knownSize < 0 || knownSize >= w.config.MinSize
+}
+
+// decide sends the headers, with knownSize the total body size or -1 if still streaming
+func (w *compressWriter) decide(knownSize int) error {
+	w.decided = true
+	header := w.Header()
+
+	w.addVary()
+
+	if w.shouldCompress(knownSize) {
+		encoder, err := compressionEncoders[w.encoding](w.ResponseWriter, w.config.Level)
+		if err != nil {
+			utils.Error("Compression: cannot create " + w.encoding + " encoder", err)
+		} else {
+			w.encoder = encoder
+			header.Del("Content-Length")
+			header.Set("Content-Encoding", w.encoding)
+
+			// the representation changed, a strong ETag is not valid anymore
+			if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+				header.Set("ETag", "W/" + etag)
+			}
+		}
+	}
+
+	w.ResponseWriter.WriteHeader(w.status)
+
+	if w.buffer.Len() > 0 {
+		buffered := w.buffer.Bytes()
+		w.buffer = bytes.Buffer{}
+		_, err := w.writeThrough(buffered)
+		return err
+	}
+
+	return nil
+}
+
+func (w *compressWriter) writeThrough(p []byte) (int, error) {
+	if w.encoder != nil {
+		return w.encoder.Write(p)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *compressWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	if w.decided {
+		return w.writeThrough(p)
+	}
+
+	w.buffer.Write(p)
+	if w.buffer.Len() >= w.config.MinSize {
+		if err := w.decide(-1); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(p), nil
+}
+
+func (w *compressWriter) Flush() {
+	if w.hijacked {
+		return
+	}
+
+	if !w.decided {
+		if !w.wroteHeader {
+			w.WriteHeader(http.StatusOK)
+		}
+		w.decide(-1)
+	}
+
+	if w.encoder != nil {
+		w.encoder.Flush()
+	}
+
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	w.hijacked = true
+	return hijacker.Hijack()
+}
+
+// Close sends what is left once the handler is done
+func (w *compressWriter) Close() {
+	if w.hijacked {
+		return
+	}
+
+	if !w.decided && w.wroteHeader {
+		w.decide(w.buffer.Len())
+	}
+
+	if w.encoder != nil {
+		if err := w.encoder.Close(); err != nil {
+			utils.Debug("Compression: error closing encoder: " + err.Error())
+		}
+	}
+}
+
+func CompressionMiddleware(route utils.ProxyRouteConfig) func(http.Handler) http.Handler {
+	config := getCompressionConfig(route)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// websockets, partial content and bodyless requests go through untouched
+			if r.Method == "HEAD" || r.Header.Get("Upgrade") != "" || r.Header.Get("Range") != "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			// empty if the client accepts none of the algorithms, the response is then only marked with Vary
+			encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"), config.Algorithms)
+
+			writer := &compressWriter{
+				ResponseWriter: w,
+				config: config,
+				encoding: encoding,
+			}
+			defer writer.Close()
+
+			next.ServeHTTP(writer, r)
+		})
+	}
+}
@@ -0,0 +1,307 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"html/template"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aseracorp/resiOS/src/utils"
+)
+
+// Custom pages are looked up in this order, first in the folder of the route then in the global one:
+// error-pages/<route>/<status>.html, error-pages/<route>/<N>xx.html, error-pages/<status>.html, error-pages/<N>xx.html
+// The maintenance page is maintenance.html, falling back to 503.html
+const errorPagesFolder = "error-pages/"
+
+var defaultErrorPage = template.Must(template.New("default").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+	<meta charset="utf-8">
+	<meta name="viewport" content="width=device-width, initial-scale=1">
+	<title>{{.Status}} {{.StatusText}}</title>
+	<style>
+		body { margin: 0; min-height: 100vh; display: flex; align-items: center; justify-content: center;
+			font-family: -apple-system, BlinkMacSystemFont, "Segoe UI", Roboto, sans-serif; background: #1e1e2f; color: #e6e6f0; }
+		main { max-width: 480px; padding: 32px; text-align: center; }
+		h1 { font-size: 56px; margin: 0 0 8px; color: #8f94fb; }
+		h2 { font-weight: 500; margin: 0 0 16px; }
+		p { line-height: 1.5; color: #b4b4c8; }
+		footer { margin-top: 32px; font-size: 12px; color: #6c6c80; }
+	</style>
+</head>
+<body>
+	<main>
+		<h1>{{.Status}}</h1>
+		<h2>{{.StatusText}}</h2>
+		<p>{{.Message}}</p>
+		{{if .RetryAfter}}<p>Please try again in a few moments.</p>{{end}}
+		<footer>resiOS</footer>
+	</main>
+</body>
+</html>
+`))
+
+// ErrorPageData is what the templates can use
+type ErrorPageData struct {
+	Status int
+	StatusText string
+	Message string
+	Route string
+	Host string
+	Path string
+	RetryAfter int
+}
+
+type cachedErrorTemplate struct {
+	modTime time.Time
+	template *template.Template
+}
+
+var errorTemplates = map[string]cachedErrorTemplate{}
+var errorTemplatesLock sync.Mutex
+
+// loadErrorTemplate returns nil if the file does not exist, templates are reloaded when modified
+func loadErrorTemplate(path string) *template.Template {
+	info, err := os.Stat(path)
+	if err != nil || info.IsDir() {
+		return nil
+	}
+
+	errorTemplatesLock.Lock()
+	defer errorTemplatesLock.Unlock()
+
+	if cached, ok := errorTemplates[path]; ok && cached.modTime.Equal(info.ModTime()) {
+		return cached.template
+	}
+
+	tmpl, err := template.ParseFiles(path)
+	if err != nil {
+		utils.Error("Error pages: cannot parse template " + path, err)
+		return nil
+	}
+
+	errorTemplates[path] = cachedErrorTemplate{
+		modTime: info.ModTime(),
+		template: tmpl,
+	}
+
+	return tmpl
+}
+
+func findErrorTemplate(routeName string, names []string) *template.Template {
+	folders := []string{}
+
+	// do not let a route name escape the error pages folder
+	if routeName != "" && routeName == filepath.Base(routeName) && routeName != ".." {
+		folders = append(folders, utils.CONFIGFOLDER + errorPagesFolder + routeName + "/")
+	}
+	folders = append(folders, utils.CONFIGFOLDER + errorPagesFolder)
+
+	for _, folder := range folders {
+		for _, name := range names {
+			if tmpl := loadErrorTemplate(folder + name + ".html"); tmpl != nil {
+				return tmpl
+			}
+		}
+	}
+
+	return nil
+}
+
+func acceptsHTML(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+func renderErrorPage(w http.ResponseWriter, r *http.Request, routeName string, names []string, data ErrorPageData) {
+	header := w.Header()
+	// the page replaces whatever the backend started to send
+	header.Del("Content-Length")
+	header.Del("Content-Encoding")
+	header.Del("ETag")
+	header.Del("Last-Modified")
+	header.Set("Cache-Control", "no-store")
+
+	if !acceptsHTML(r) {
+		http.Error(w, data.Message, data.Status)
+		return
+	}
+
+	var page bytes.Buffer
+	tmpl := findErrorTemplate(routeName, names)
+	if tmpl == nil || tmpl.Execute(&page, data) != nil {
+		page.Reset()
+		defaultErrorPage.Execute(&page, data)
+	}
+
+	header.Set("Content-Type", "text/html; charset=utf-8")
+	header.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(data.Status)
+	w.Write(page.Bytes())
+}
+
+func newErrorPageData(r *http.Request, routeName string, status int, message string) ErrorPageData {
+	return ErrorPageData{
+		Status: status,
+		StatusText: http.StatusText(status),
+		Message: message,
+		Route: routeName,
+		Host: r.Host,
+		Path: r.URL.Path,
+	}
+}
+
+// ServeErrorPage answers with the custom page of the route for this status, or the default one
+func ServeErrorPage(w http.ResponseWriter, r *http.Request, routeName string, status int, message string) {
+	statusCode := strconv.Itoa(status)
+	names := []string{statusCode, statusCode[:1] + "xx"}
+
+	renderErrorPage(w, r, routeName, names, newErrorPageData(r, routeName, status, message))
+}
+
+func serveMaintenancePage(w http.ResponseWriter, r *http.Request, routeName string, state utils.MaintenanceState) {
+	message := state.Message
+	if message == "" {
+		message = "This service is under maintenance and will be back soon."
+	}
+
+	data := newErrorPageData(r, routeName, http.StatusServiceUnavailable, message)
+
+	if state.RetryAfter > 0 {
+		data.RetryAfter = state.RetryAfter
+		w.Header().Set("Retry-After", strconv.Itoa(state.RetryAfter))
+	}
+
+	renderErrorPage(w, r, routeName, []string{"maintenance", "503", "5xx"}, data)
+}
+
+// getRouteMaintenance checks the manual toggle and the containers being updated behind the route
+func getRouteMaintenance(route utils.ProxyRouteConfig) (utils.MaintenanceState, bool) {
+	if state, ok := utils.GetRouteMaintenance(route.Name); ok {
+		return state, true
+	}
+
+	if route.Mode != "SERVAPP" {
+		return utils.MaintenanceState{}, false
+	}
+
+	// only when no container is left to answer
+	var containerState utils.MaintenanceState
+	for _, target := range GetRouteTargets(route) {
+		targetURL, err := url.Parse(target.Target)
+		if err != nil {
+			return utils.MaintenanceState{}, false
+		}
+
+		state, ok := utils.GetContainerMaintenance(targetURL.Hostname())
+		if !ok {
+			return utils.MaintenanceState{}, false
+		}
+		containerState = state
+	}
+
+	return containerState, true
+}
+
+// MaintenanceMiddleware serves the maintenance page to everyone but the admins
+func MaintenanceMiddleware(route utils.ProxyRouteConfig) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if state, ok := getRouteMaintenance(route); ok && !utils.IsAdmin(r) {
+				utils.Debug("Route " + route.Name + " is in maintenance, serving maintenance page")
+				serveMaintenancePage(w, r, route.Name, state)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// errorPagesWriter replaces the error responses of the backend by the error pages
+type errorPagesWriter struct {
+	http.ResponseWriter
+	r *http.Request
+	route utils.ProxyRouteConfig
+	intercept map[int]bool
+	wroteHeader bool
+	intercepted bool
+}
+
+func (w *errorPagesWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	if status < 200 {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	w.wroteHeader = true
+
+	if w.intercept[status] && acceptsHTML(w.r) {
+		w.intercepted = true
+		utils.Debug("Error pages: replacing " + strconv.Itoa(status) + " response of route " + w.route.Name)
+		ServeErrorPage(w.ResponseWriter, w.r, w.route.Name, status, http.StatusText(status))
+		return
+	}
+
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *errorPagesWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.intercepted {
+		return len(p), nil
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *errorPagesWriter) Flush() {
+	if w.intercepted {
+		return
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *errorPagesWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	return hijacker.Hijack()
+}
+
+func ErrorPagesMiddleware(route utils.ProxyRouteConfig) func(http.Handler) http.Handler {
+	statuses := route.ErrorPages.InterceptStatus
+	if len(statuses) == 0 {
+		statuses = []int{500, 502, 503, 504}
+	}
+
+	intercept := map[int]bool{}
+	for _, status := range statuses {
+		intercept[status] = true
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(&errorPagesWriter{
+				ResponseWriter: w,
+				r: r,
+				route: route,
+				intercept: intercept,
+			}, r)
+		})
+	}
+}
@@ -0,0 +1,174 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aseracorp/resiOS/src/utils"
+)
+
+// max size of the provider's answer sent back to the client (login pages, error messages)
+const forwardAuthMaxBody = 1024 * 1024
+
+var forwardAuthHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+	"Content-Length",
+}
+
+// the credentials and identity of Cosmos, the provider has its own
+var forwardAuthCosmosHeaders = []string{
+	"Authorization",
+	"x-cosmos-user",
+	"x-cosmos-role",
+	"x-cosmos-mfa",
+	"x-cstln-auth",
+}
+
+// one transport per TLS setting, shared by the routes and kept across the reloads of the config
+var forwardAuthTransports = map[bool]*http.Transport{}
+var forwardAuthTransportsLock sync.Mutex
+
+func getForwardAuthTransport(acceptInsecureHTTPS bool) *http.Transport {
+	forwardAuthTransportsLock.Lock()
+	defer forwardAuthTransportsLock.Unlock()
+
+	transport, ok := forwardAuthTransports[acceptInsecureHTTPS]
+	if !ok {
+		transport = &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: acceptInsecureHTTPS},
+			IdleConnTimeout: 90 * time.Second,
+		}
+		forwardAuthTransports[acceptInsecureHTTPS] = transport
+	}
+
+	return transport
+}
+
+func newForwardAuthRequest(r *http.Request, config utils.ProxyForwardAuthConfig) (*http.Request, error) {
+	authReq, err := http.NewRequestWithContext(r.Context(), "GET", config.Address, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(config.AuthRequestHeaders) > 0 {
+		for _, name := range config.AuthRequestHeaders {
+			for _, value := range r.Header.Values(name) {
+				authReq.Header.Add(name, value)
+			}
+		}
+	} else {
+		authReq.Header = r.Header.Clone()
+		for _, name := range forwardAuthHopHeaders {
+			authReq.Header.Del(name)
+		}
+		for _, name := range forwardAuthCosmosHeaders {
+			authReq.Header.Del(name)
+		}
+	}
+
+	// the Cosmos session is never sent to the provider, even when Cookie is listed
+	removeCosmosTokenCookie(authReq)
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+
+	clientIP := utils.GetClientIP(r)
+
+	// same headers as Traefik, understood by Authelia, Authentik, oauth2-proxy...
+	authReq.Header.Set("X-Forwarded-Method", r.Method)
+	authReq.Header.Set("X-Forwarded-Proto", scheme)
+	authReq.Header.Set("X-Forwarded-Host", r.Host)
+	authReq.Header.Set("X-Forwarded-Uri", r.URL.RequestURI())
+	authReq.Header.Set("X-Forwarded-For", clientIP)
+	authReq.Header.Set("X-Original-URL", scheme + "://" + r.Host + r.URL.RequestURI())
+
+	return authReq, nil
+}
+
+// ForwardAuthMiddleware asks an external identity provider if the request is allowed before proxying it
+func ForwardAuthMiddleware(route utils.ProxyRouteConfig) func(next http.Handler) http.Handler {
+	config := route.ForwardAuth
+
+	timeout := time.Duration(config.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+
+	client := &http.Client{
+		Timeout: timeout,
+		Transport: getForwardAuthTransport(config.AcceptInsecureHTTPS),
+		// redirects are meant for the user's browser
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// do not let the client inject the identity headers of the provider
+			for _, name := range config.AuthResponseHeaders {
+				r.Header.Del(name)
+			}
+
+			authReq, err := newForwardAuthRequest(r, config)
+			if err != nil {
+				utils.Error("ForwardAuth: cannot create request to " + config.Address + " for route " + route.Name, err)
+				utils.HTTPError(w, "Authorization Error", http.StatusInternalServerError, "A001")
+				return
+			}
+
+			resp, err := client.Do(authReq)
+			if err != nil {
+				utils.Error("ForwardAuth: cannot reach " + config.Address + " for route " + route.Name, err)
+				utils.HTTPError(w, "Authorization provider unreachable", http.StatusBadGateway, "A002")
+				return
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+				for _, name := range config.AuthResponseHeaders {
+					for _, value := range resp.Header.Values(name) {
+						r.Header.Add(name, value)
+					}
+				}
+
+				// keep the provider's session refreshed
+				for _, cookie := range resp.Header.Values("Set-Cookie") {
+					w.Header().Add("Set-Cookie", cookie)
+				}
+
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			utils.Debug("ForwardAuth: " + config.Address + " denied " + r.Host + r.URL.Path + " with status " + resp.Status)
+
+			// send the provider's answer (redirect to login, 401, 403...) back to the user as is
+			for name, values := range resp.Header {
+				if strings.EqualFold(name, "Content-Length") {
+					continue
+				}
+				w.Header().Del(name)
+				for _, value := range values {
+					w.Header().Add(name, value)
+				}
+			}
+
+			w.WriteHeader(resp.StatusCode)
+			io.Copy(w, io.LimitReader(resp.Body, forwardAuthMaxBody))
+		})
+	}
+}
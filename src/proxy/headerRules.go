@@ -0,0 +1,227 @@
+package proxy
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/aseracorp/resiOS/src/utils"
+)
+
+type headerRule struct {
+	utils.ProxyHeaderRule
+	match *regexp.Regexp
+}
+
+// compileHeaderRules validates the rules of a route and drops the invalid ones
+func compileHeaderRules(route utils.ProxyRouteConfig) []headerRule {
+	rules := []headerRule{}
+
+	for _, rule := range route.HeaderRules {
+		rule.Target = strings.ToUpper(rule.Target)
+		rule.Action = strings.ToUpper(rule.Action)
+
+		if _, ok := utils.HeaderRuleTargetList[rule.Target]; !ok {
+			utils.Error("Header rules: invalid target " + rule.Target + " on route " + route.Name, nil)
+			continue
+		}
+		if _, ok := utils.HeaderRuleActionList[rule.Action]; !ok {
+			utils.Error("Header rules: invalid action " + rule.Action + " on route " + route.Name, nil)
+			continue
+		}
+		if rule.Name == "" {
+			utils.Error("Header rules: missing name on route " + route.Name, nil)
+			continue
+		}
+		if rule.Target == "COOKIE" && rule.Attribute == "" {
+			utils.Error("Header rules: missing cookie attribute on route " + route.Name, nil)
+			continue
+		}
+
+		compiled := headerRule{ProxyHeaderRule: rule}
+
+		if rule.Action == "REPLACE" {
+			match, err := regexp.Compile(rule.Match)
+			if err != nil {
+				utils.Error("Header rules: invalid regex " + rule.Match + " on route " + route.Name, err)
+				continue
+			}
+			compiled.match = match
+		}
+
+		rules = append(rules, compiled)
+	}
+
+	return rules
+}
+
+// headerRuleVariables is computed from the incoming request, before any rule is applied
+func headerRuleVariables(r *http.Request, route utils.ProxyRouteConfig) *strings.Replacer {
+	clientIP := utils.GetClientIP(r)
+
+	scheme := "http"
+	if utils.IsHTTPS {
+		scheme = "https"
+	}
+
+	return strings.NewReplacer(
+		"{client_ip}", clientIP,
+		"{user}", r.Header.Get("x-cosmos-user"),
+		"{role}", r.Header.Get("x-cosmos-role"),
+		"{route}", route.Name,
+		"{host}", r.Host,
+		"{path}", r.URL.Path,
+		"{method}", r.Method,
+		"{scheme}", scheme,
+	)
+}
+
+func applyHeaderRule(header http.Header, rule headerRule, value string) {
+	switch rule.Action {
+	case "SET":
+		header.Set(rule.Name, value)
+	case "ADD":
+		header.Add(rule.Name, value)
+	case "REMOVE":
+		header.Del(rule.Name)
+	case "REPLACE":
+		values := header.Values(rule.Name)
+		if len(values) == 0 {
+			return
+		}
+		header.Del(rule.Name)
+		for _, old := range values {
+			header.Add(rule.Name, rule.match.ReplaceAllString(old, value))
+		}
+	}
+}
+
+// rewriteSetCookie edits the attributes of a Set-Cookie line without re-serializing it,
+// so attributes unknown to net/http are kept
+func rewriteSetCookie(line string, rule headerRule, value string) string {
+	parts := strings.Split(line, ";")
+
+	cookieName := strings.TrimSpace(strings.SplitN(parts[0], "=", 2)[0])
+	if rule.Name != "*" && cookieName != rule.Name {
+		return line
+	}
+
+	result := []string{parts[0]}
+	found := false
+
+	for _, part := range parts[1:] {
+		keyValue := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if !strings.EqualFold(keyValue[0], rule.Attribute) {
+			result = append(result, part)
+			continue
+		}
+
+		found = true
+		switch rule.Action {
+		case "SET":
+			if value == "" {
+				result = append(result, " " + rule.Attribute)
+			} else {
+				result = append(result, " " + rule.Attribute + "=" + value)
+			}
+		case "ADD":
+			result = append(result, part)
+		case "REMOVE":
+			// dropped
+		case "REPLACE":
+			if len(keyValue) == 2 {
+				result = append(result, " " + keyValue[0] + "=" + rule.match.ReplaceAllString(keyValue[1], value))
+			} else {
+				result = append(result, part)
+			}
+		}
+	}
+
+	if !found && (rule.Action == "SET" || rule.Action == "ADD") {
+		if value == "" {
+			result = append(result, " " + rule.Attribute)
+		} else {
+			result = append(result, " " + rule.Attribute + "=" + value)
+		}
+	}
+
+	return strings.Join(result, ";")
+}
+
+// headerRulesWriter applies the response rules right before the headers are sent
+type headerRulesWriter struct {
+	http.ResponseWriter
+	apply func(header http.Header)
+	wroteHeader bool
+}
+
+func (w *headerRulesWriter) WriteHeader(status int) {
+	if !w.wroteHeader && (status >= 200 || status == http.StatusSwitchingProtocols) {
+		w.wroteHeader = true
+		w.apply(w.Header())
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *headerRulesWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *headerRulesWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *headerRulesWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	return hijacker.Hijack()
+}
+
+func HeaderRulesMiddleware(route utils.ProxyRouteConfig) func(http.Handler) http.Handler {
+	rules := compileHeaderRules(route)
+
+	utils.Debug("Header rules: " + strconv.Itoa(len(rules)) + " rules loaded for route " + route.Name)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			variables := headerRuleVariables(r, route)
+
+			for _, rule := range rules {
+				if rule.Target == "REQUEST" {
+					applyHeaderRule(r.Header, rule, variables.Replace(rule.Value))
+				}
+			}
+
+			writer := &headerRulesWriter{
+				ResponseWriter: w,
+				apply: func(header http.Header) {
+					for _, rule := range rules {
+						value := variables.Replace(rule.Value)
+
+						if rule.Target == "RESPONSE" {
+							applyHeaderRule(header, rule, value)
+						} else if rule.Target == "COOKIE" {
+							cookies := header.Values("Set-Cookie")
+							header.Del("Set-Cookie")
+							for _, cookie := range cookies {
+								header.Add("Set-Cookie", rewriteSetCookie(cookie, rule, value))
+							}
+						}
+					}
+				},
+			}
+
+			next.ServeHTTP(writer, r)
+		})
+	}
+}
@@ -0,0 +1,222 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/aseracorp/resiOS/src/utils"
+	"github.com/aseracorp/resiOS/src/metrics"
+)
+
+func getHealthCheckConfig(route utils.ProxyRouteConfig) utils.ProxyHealthCheckConfig {
+	config := route.HealthCheck
+
+	if config.Type != "TCP" {
+		config.Type = "HTTP"
+	}
+	if config.Path == "" {
+		config.Path = "/"
+	}
+	if config.Interval <= 0 {
+		config.Interval = 30
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = 5
+	}
+	if config.HealthyThreshold <= 0 {
+		config.HealthyThreshold = 2
+	}
+	if config.UnhealthyThreshold <= 0 {
+		config.UnhealthyThreshold = 3
+	}
+
+	return config
+}
+
+func (lb *LoadBalancer) startHealthChecks() {
+	config := getHealthCheckConfig(lb.route)
+	stop := make(chan bool)
+	lb.stopHealthChecks = stop
+
+	utils.Log("Starting " + config.Type + " health checks for route " + lb.route.Name + " every " + strconv.Itoa(config.Interval) + "s")
+
+	go func() {
+		ticker := time.NewTicker(time.Duration(config.Interval) * time.Second)
+		defer ticker.Stop()
+
+		lb.checkUpstreams(config)
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				lb.checkUpstreams(config)
+			}
+		}
+	}()
+}
+
+func (lb *LoadBalancer) StopHealthChecks() {
+	if lb.stopHealthChecks != nil {
+		close(lb.stopHealthChecks)
+		lb.stopHealthChecks = nil
+	}
+}
+
+func probeUpstream(route utils.ProxyRouteConfig, config utils.ProxyHealthCheckConfig, upstream *Upstream) error {
+	timeout := time.Duration(config.Timeout) * time.Second
+
+	if config.Type == "TCP" {
+		network := "tcp"
+		var address string
+
+		if upstream.url.Scheme == "unix" {
+			socketPath, err := getUnixSocketPath(upstream.url)
+			if err != nil {
+				return err
+			}
+			network = "unix"
+			address = socketPath
+		} else {
+			address = getUpstreamHost(route, upstream.url)
+			if upstream.url.Port() == "" {
+				if upstream.url.Scheme == "https" {
+					address = address + ":443"
+				} else {
+					address = address + ":80"
+				}
+			}
+		}
+
+		conn, err := net.DialTimeout(network, address, timeout)
+		if err != nil {
+			return err
+		}
+		conn.Close()
+		return nil
+	}
+
+	// same transport as the proxy, to also check unix sockets and h2c upstreams
+	transport, directorURL, err := newUpstreamTransport(upstream.url, route.AcceptInsecureHTTPSTarget, route)
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{
+		Timeout: timeout,
+		Transport: transport,
+		// redirects are a valid answer, do not follow them
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	defer client.CloseIdleConnections()
+
+	host := directorURL.Host
+	if upstream.url.Scheme != "unix" {
+		host = getUpstreamHost(route, upstream.url)
+	}
+
+	probeURL := url.URL{
+		Scheme: directorURL.Scheme,
+		Host: host,
+		Path: config.Path,
+	}
+
+	req, err := http.NewRequest("GET", probeURL.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", "Cosmos-HealthCheck")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if config.ExpectedStatus != 0 {
+		if resp.StatusCode != config.ExpectedStatus {
+			return errors.New("unexpected status " + strconv.Itoa(resp.StatusCode) + ", expected " + strconv.Itoa(config.ExpectedStatus))
+		}
+	} else if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+		return errors.New("unexpected status " + strconv.Itoa(resp.StatusCode))
+	}
+
+	return nil
+}
+
+func (lb *LoadBalancer) checkUpstreams(config utils.ProxyHealthCheckConfig) {
+	healthyCount := 0
+
+	for _, upstream := range lb.Upstreams {
+		err := probeUpstream(lb.route, config, upstream)
+
+		lb.Lock()
+		changed := false
+		upstream.lastCheck = time.Now()
+		if err != nil {
+			utils.Debug("Health check failed for " + upstream.Target + " on route " + lb.route.Name + ": " + err.Error())
+			upstream.lastError = err.Error()
+			upstream.successes = 0
+			upstream.failures++
+			if upstream.IsHealthy() && upstream.failures >= config.UnhealthyThreshold {
+				atomic.StoreInt32(&upstream.down, 1)
+				changed = true
+			}
+		} else {
+			upstream.lastError = ""
+			upstream.failures = 0
+			upstream.successes++
+			if !upstream.IsHealthy() && upstream.successes >= config.HealthyThreshold {
+				atomic.StoreInt32(&upstream.down, 0)
+				changed = true
+			}
+		}
+		lastError := upstream.lastError
+		lb.Unlock()
+
+		if upstream.IsHealthy() {
+			healthyCount++
+		}
+
+		if changed {
+			state := "up"
+			level := "success"
+			if !upstream.IsHealthy() {
+				state = "down"
+				level = "error"
+				utils.Warn("Upstream " + upstream.Target + " of route " + lb.route.Name + " is down and removed from rotation: " + lastError)
+			} else {
+				utils.Log("Upstream " + upstream.Target + " of route " + lb.route.Name + " is back up")
+			}
+
+			utils.TriggerEvent(
+				"cosmos.proxy.route.health",
+				"Proxy Route " + lb.route.Name + " upstream " + state,
+				level,
+				"route@" + lb.route.Name,
+				map[string]interface{}{
+				"route": lb.route.Name,
+				"target": upstream.Target,
+				"healthy": upstream.IsHealthy(),
+				"error": lastError,
+			})
+		}
+	}
+
+	metrics.PushSetMetric("proxy.route.health." + lb.route.Name, healthyCount, metrics.DataDef{
+		Max: uint64(len(lb.Upstreams)),
+		Period: time.Second * 30,
+		Label: "Healthy Upstreams " + lb.route.Name,
+		AggloType: "min",
+		SetOperation: "min",
+		Object: "route@" + lb.route.Name,
+	})
+}
@@ -0,0 +1,441 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aseracorp/resiOS/src/utils"
+)
+
+type Upstream struct {
+	Target string
+	Name string
+	Weight int
+	matchHeader string
+	matchCookie string
+	matchValue string
+	url *url.URL
+	proxy *httputil.ReverseProxy
+	activeConnections int64
+	totalRequests int64
+	currentWeight int
+	down int32
+	successes int
+	failures int
+	lastCheck time.Time
+	lastError string
+}
+
+func (upstream *Upstream) IsHealthy() bool {
+	return atomic.LoadInt32(&upstream.down) == 0
+}
+
+type UpstreamStatus struct {
+	Target string `json:"target"`
+	Name string `json:"name"`
+	Weight int `json:"weight"`
+	ActiveConnections int64 `json:"activeConnections"`
+	TotalRequests int64 `json:"totalRequests"`
+	Healthy bool `json:"healthy"`
+	LastCheck time.Time `json:"lastCheck"`
+	LastError string `json:"lastError"`
+}
+
+type LoadBalancer struct {
+	sync.Mutex
+	route utils.ProxyRouteConfig
+	Strategy string
+	Upstreams []*Upstream
+	next int
+	stopHealthChecks chan bool
+}
+
+type LoadBalancerStatus struct {
+	Route string `json:"route"`
+	Strategy string `json:"strategy"`
+	Upstreams []UpstreamStatus `json:"upstreams"`
+	Schedule *ScheduleStatus `json:"schedule,omitempty"`
+}
+
+var loadBalancers = map[string]*LoadBalancer{}
+var loadBalancersLock sync.Mutex
+
+// GetRouteTargets returns the list of upstreams of a route, falling back to Target
+func GetRouteTargets(route utils.ProxyRouteConfig) []utils.ProxyTargetConfig {
+	if len(route.Targets) > 0 {
+		targets := []utils.ProxyTargetConfig{}
+		for _, target := range route.Targets {
+			target.Target = normalizeTarget(target.Target)
+			targets = append(targets, target)
+		}
+		return targets
+	}
+
+	return []utils.ProxyTargetConfig{
+		{
+			Target: normalizeTarget(route.Target),
+			Weight: 1,
+		},
+	}
+}
+
+func NewLoadBalancer(route utils.ProxyRouteConfig) *LoadBalancer {
+	strategy := route.LoadBalancingStrategy
+	if _, ok := utils.LoadBalancingStrategyList[strategy]; !ok {
+		if strategy != "" {
+			utils.Warn("Unknown load balancing strategy " + strategy + " for route " + route.Name + ". Using ROUND_ROBIN")
+		}
+		strategy = utils.LoadBalancingStrategyList["ROUND_ROBIN"]
+	}
+
+	lb := &LoadBalancer{
+		route: route,
+		Strategy: strategy,
+		Upstreams: []*Upstream{},
+	}
+
+	for _, target := range GetRouteTargets(route) {
+		targetURL, err := url.Parse(target.Target)
+		if err != nil {
+			utils.Error("Create Route upstream " + target.Target, err)
+			continue
+		}
+
+		proxy, err := NewProxy(target.Target, route.AcceptInsecureHTTPSTarget, route.DisableHeaderHardening, route)
+		if err != nil {
+			utils.Error("Create Route upstream " + target.Target, err)
+			continue
+		}
+
+		hasMatch := target.MatchHeader != "" || target.MatchCookie != ""
+
+		weight := target.Weight
+		if weight <= 0 {
+			weight = 1
+			if hasMatch {
+				weight = 0
+			}
+		}
+
+		lb.Upstreams = append(lb.Upstreams, &Upstream{
+			Target: target.Target,
+			Name: getUpstreamName(target),
+			Weight: weight,
+			matchHeader: target.MatchHeader,
+			matchCookie: target.MatchCookie,
+			matchValue: target.MatchValue,
+			url: targetURL,
+			proxy: proxy,
+		})
+	}
+
+	if route.HealthCheck.Enabled {
+		lb.startHealthChecks()
+	}
+
+	loadBalancersLock.Lock()
+	loadBalancers[route.Name] = lb
+	loadBalancersLock.Unlock()
+
+	return lb
+}
+
+// getUpstreamName is the name of a target in the metrics and the sticky cookie
+func getUpstreamName(target utils.ProxyTargetConfig) string {
+	if target.Name != "" {
+		return utils.SanitizeName(target.Name)
+	}
+
+	name := target.Target
+	if targetURL, err := url.Parse(target.Target); err == nil && targetURL.Host != "" {
+		name = targetURL.Host + targetURL.Path
+	}
+	return strings.Trim(utils.SanitizeName(name), "_")
+}
+
+// matches tells if the request carries the header or cookie of a canary target
+func (upstream *Upstream) matches(r *http.Request) bool {
+	if upstream.matchHeader != "" {
+		for _, value := range r.Header.Values(upstream.matchHeader) {
+			if upstream.matchValue == "" || value == upstream.matchValue {
+				return true
+			}
+		}
+	}
+
+	if upstream.matchCookie != "" {
+		cookie, err := r.Cookie(upstream.matchCookie)
+		if err == nil && (upstream.matchValue == "" || cookie.Value == upstream.matchValue) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// routeRequestInfo is filled along the middlewares of a route, for the metrics and the access logs
+type routeRequestInfoCtxKey struct{}
+
+type routeRequestInfo struct {
+	sync.Mutex
+	upstream string
+	shield string
+}
+
+func (info *routeRequestInfo) SetUpstream(name string) {
+	info.Lock()
+	info.upstream = name
+	info.Unlock()
+}
+
+func (info *routeRequestInfo) Upstream() string {
+	info.Lock()
+	defer info.Unlock()
+	return info.upstream
+}
+
+// SetShield records why the shield blocked or slowed down the request
+func (info *routeRequestInfo) SetShield(decision string) {
+	info.Lock()
+	info.shield = decision
+	info.Unlock()
+}
+
+func (info *routeRequestInfo) Shield() string {
+	info.Lock()
+	defer info.Unlock()
+	return info.shield
+}
+
+// withRouteRequestInfo returns the info already attached to the request, or attaches a new one
+func withRouteRequestInfo(r *http.Request) (*http.Request, *routeRequestInfo) {
+	if info := getRouteRequestInfo(r); info != nil {
+		return r, info
+	}
+
+	info := &routeRequestInfo{}
+	return r.WithContext(context.WithValue(r.Context(), routeRequestInfoCtxKey{}, info)), info
+}
+
+func getRouteRequestInfo(r *http.Request) *routeRequestInfo {
+	info, _ := r.Context().Value(routeRequestInfoCtxKey{}).(*routeRequestInfo)
+	return info
+}
+
+func ResetLoadBalancers() {
+	loadBalancersLock.Lock()
+	defer loadBalancersLock.Unlock()
+
+	for _, lb := range loadBalancers {
+		lb.StopHealthChecks()
+	}
+
+	loadBalancers = map[string]*LoadBalancer{}
+}
+
+func (lb *LoadBalancer) pick(r *http.Request, candidates []*Upstream) *Upstream {
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	lb.Lock()
+	defer lb.Unlock()
+
+	switch lb.Strategy {
+	case "LEAST_CONN":
+		var best *Upstream
+		for _, upstream := range candidates {
+			// compare active/weight ratios without dividing
+			if best == nil ||
+				atomic.LoadInt64(&upstream.activeConnections) * int64(best.Weight) <
+				atomic.LoadInt64(&best.activeConnections) * int64(upstream.Weight) {
+				best = upstream
+			}
+		}
+		return best
+	case "IP_HASH":
+		hash := fnv.New32a()
+		hash.Write([]byte(GetClientID(r, lb.route)))
+		return candidates[hash.Sum32() % uint32(len(candidates))]
+	case "WEIGHTED":
+		// smooth weighted round-robin
+		var best *Upstream
+		total := 0
+		for _, upstream := range candidates {
+			upstream.currentWeight += upstream.Weight
+			total += upstream.Weight
+			if best == nil || upstream.currentWeight > best.currentWeight {
+				best = upstream
+			}
+		}
+		best.currentWeight -= total
+		return best
+	default:
+		upstream := candidates[lb.next % len(candidates)]
+		lb.next = (lb.next + 1) % len(candidates)
+		return upstream
+	}
+}
+
+// healthyUpstreams returns the upstreams still in rotation
+func (lb *LoadBalancer) healthyUpstreams() []*Upstream {
+	healthy := []*Upstream{}
+	for _, upstream := range lb.Upstreams {
+		if upstream.IsHealthy() {
+			healthy = append(healthy, upstream)
+		}
+	}
+	return healthy
+}
+
+func (lb *LoadBalancer) stickyCookieName() string {
+	hash := fnv.New32a()
+	hash.Write([]byte(lb.route.Name))
+	return fmt.Sprintf("cosmos-lb-%08x", hash.Sum32())
+}
+
+// selectUpstream applies, in order, the match rules, the sticky cookie and the strategy
+func (lb *LoadBalancer) selectUpstream(w http.ResponseWriter, r *http.Request) *Upstream {
+	healthy := lb.healthyUpstreams()
+
+	for _, upstream := range healthy {
+		if upstream.matches(r) {
+			return upstream
+		}
+	}
+
+	if lb.route.StickySessions {
+		if cookie, err := r.Cookie(lb.stickyCookieName()); err == nil {
+			for _, upstream := range healthy {
+				if upstream.Name == cookie.Value && upstream.Weight > 0 {
+					return upstream
+				}
+			}
+		}
+	}
+
+	candidates := []*Upstream{}
+	for _, upstream := range healthy {
+		if upstream.Weight > 0 {
+			candidates = append(candidates, upstream)
+		}
+	}
+
+	// only canary targets left, better than a 502
+	if len(candidates) == 0 {
+		candidates = healthy
+	}
+
+	upstream := lb.pick(r, candidates)
+
+	if upstream != nil && lb.route.StickySessions {
+		http.SetCookie(w, &http.Cookie{
+			Name: lb.stickyCookieName(),
+			Value: upstream.Name,
+			Path: "/",
+			MaxAge: 24 * 60 * 60,
+			HttpOnly: true,
+			Secure: r.TLS != nil,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+
+	return upstream
+}
+
+func (lb *LoadBalancer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	upstream := lb.selectUpstream(w, r)
+
+	if upstream == nil {
+		utils.Error("No upstream available for route " + lb.route.Name, nil)
+		ServeErrorPage(w, r, lb.route.Name, http.StatusBadGateway, "502 Bad Gateway. This means your container / backend is not reachable by Cosmos.")
+		return
+	}
+
+	utils.Debug("LoadBalancer: " + lb.route.Name + " forwarding to " + upstream.Target)
+
+	if info := getRouteRequestInfo(r); info != nil {
+		info.SetUpstream(upstream.Name)
+	}
+
+	atomic.AddInt64(&upstream.activeConnections, 1)
+	atomic.AddInt64(&upstream.totalRequests, 1)
+	defer atomic.AddInt64(&upstream.activeConnections, -1)
+
+	upstream.proxy.ServeHTTP(w, r)
+}
+
+func (lb *LoadBalancer) Status() LoadBalancerStatus {
+	status := LoadBalancerStatus{
+		Route: lb.route.Name,
+		Strategy: lb.Strategy,
+		Upstreams: []UpstreamStatus{},
+	}
+
+	lb.Lock()
+	defer lb.Unlock()
+
+	for _, upstream := range lb.Upstreams {
+		status.Upstreams = append(status.Upstreams, UpstreamStatus{
+			Target: upstream.Target,
+			Name: upstream.Name,
+			Weight: upstream.Weight,
+			ActiveConnections: atomic.LoadInt64(&upstream.activeConnections),
+			TotalRequests: atomic.LoadInt64(&upstream.totalRequests),
+			Healthy: upstream.IsHealthy(),
+			LastCheck: upstream.lastCheck,
+			LastError: upstream.lastError,
+		})
+	}
+
+	return status
+}
+
+func GetLoadBalancersStatus() map[string]LoadBalancerStatus {
+	loadBalancersLock.Lock()
+	defer loadBalancersLock.Unlock()
+
+	result := map[string]LoadBalancerStatus{}
+	for name, lb := range loadBalancers {
+		result[name] = lb.Status()
+	}
+
+	return result
+}
+
+// GetRoutesStatus adds the routes with an access schedule to the status of the load balancers
+func GetRoutesStatus() map[string]LoadBalancerStatus {
+	result := GetLoadBalancersStatus()
+
+	for _, route := range utils.GetMainConfig().HTTPConfig.ProxyConfig.Routes {
+		if route.Disabled || !route.AccessSchedule.Enabled {
+			continue
+		}
+
+		status, ok := result[route.Name]
+		if !ok {
+			status = LoadBalancerStatus{
+				Route: route.Name,
+				Upstreams: []UpstreamStatus{},
+			}
+		}
+
+		schedule, err := GetRouteScheduleStatus(route)
+		if err != nil {
+			utils.Error("Access schedule of route " + route.Name, err)
+		}
+		status.Schedule = &schedule
+
+		result[route.Name] = status
+	}
+
+	return result
+}
@@ -0,0 +1,198 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/aseracorp/resiOS/src/metrics"
+	"github.com/aseracorp/resiOS/src/utils"
+)
+
+// mirrored requests in flight per route, the extra ones are dropped rather than queued
+const mirrorMaxInFlight = 64
+
+func pushMirrorMetrics(route utils.ProxyRouteConfig, result string) {
+	if utils.GetMainConfig().MonitoringDisabled {
+		return
+	}
+
+	labels := map[string]string{
+		"success": "Mirrored Requests ",
+		"error": "Mirror Errors ",
+		"dropped": "Mirror Dropped ",
+	}
+
+	metrics.PushSetMetric("proxy.mirror." + result + "." + route.Name, 1, metrics.DataDef{
+		Max: 0,
+		Period: time.Second * 30,
+		Label: labels[result] + route.Name,
+		AggloType: "sum",
+		SetOperation: "sum",
+		Object: "route@" + route.Name,
+	})
+}
+
+// peekRequestBody reads up to maxSize bytes of the body, complete is false if there is more or it cannot be read.
+// The request body is always left intact
+func peekRequestBody(r *http.Request, maxSize int64) (body []byte, complete bool) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, true
+	}
+
+	buffer, err := io.ReadAll(io.LimitReader(r.Body, maxSize + 1))
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(buffer), r.Body), r.Body}
+
+	if int64(len(buffer)) > maxSize {
+		return buffer[:maxSize], false
+	}
+
+	return buffer, err == nil
+}
+
+// the credentials of the users are not sent to the shadow backend by default
+var mirrorCredentialHeaders = []string{
+	"Authorization",
+	"Cookie",
+}
+
+// MirrorMiddleware sends a copy of a share of the requests to a secondary upstream, its answers are discarded
+func MirrorMiddleware(route utils.ProxyRouteConfig) func(next http.Handler) http.Handler {
+	config := route.Mirror
+
+	percentage := config.Percentage
+	if percentage <= 0 {
+		utils.Log("Mirror: percentage of route " + route.Name + " is 0, mirroring paused")
+		return func(next http.Handler) http.Handler {
+			return next
+		}
+	}
+	if percentage > 100 {
+		percentage = 100
+	}
+
+	maxBodySize := config.MaxBodySize
+	if maxBodySize <= 0 {
+		maxBodySize = 1024 * 1024
+	}
+
+	timeout := time.Duration(config.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+
+	targetURL, err := url.Parse(normalizeTarget(config.Target))
+	if err == nil && targetURL.Host == "" && targetURL.Scheme != "unix" {
+		err = errors.New("target " + config.Target + " has no host")
+	}
+
+	var client *http.Client
+	if err == nil {
+		var transport http.RoundTripper
+		transport, targetURL, err = newUpstreamTransport(targetURL, config.AcceptInsecureHTTPS, route)
+		client = &http.Client{
+			Timeout: timeout,
+			Transport: transport,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}
+	}
+
+	if err != nil {
+		utils.Error("Mirror: invalid target for route " + route.Name + ", mirroring disabled", err)
+		return func(next http.Handler) http.Handler {
+			return next
+		}
+	}
+
+	inFlight := make(chan struct{}, mirrorMaxInFlight)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if percentage < 100 && rand.Intn(100) >= percentage {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			var body []byte
+			ok := r.ContentLength <= maxBodySize
+			if ok {
+				body, ok = peekRequestBody(r, maxBodySize)
+			}
+			if !ok {
+				utils.Debug("Mirror: body of " + r.URL.Path + " is over the limit of route " + route.Name + ", not mirrored")
+				pushMirrorMetrics(route, "dropped")
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			select {
+			case inFlight <- struct{}{}:
+				mirrorURL := *r.URL
+				mirrorURL.Scheme = targetURL.Scheme
+				if targetURL.Scheme == "unix" {
+					mirrorURL.Host = targetURL.Host
+				} else {
+					mirrorURL.Host = getUpstreamHost(route, targetURL)
+				}
+				mirrorURL.Path, mirrorURL.RawPath = joinURLPath(targetURL, r.URL)
+
+				header := r.Header.Clone()
+				for _, name := range forwardAuthHopHeaders {
+					header.Del(name)
+				}
+				if !config.ForwardCredentials {
+					for _, name := range mirrorCredentialHeaders {
+						header.Del(name)
+					}
+				}
+				header.Set("X-Forwarded-For", utils.GetClientIP(r))
+				header.Set("X-Cosmos-Mirror", route.Name)
+
+				go func() {
+					defer func() { <-inFlight }()
+
+					// the copy must outlive the original request
+					mirrorReq, err := http.NewRequestWithContext(context.Background(), r.Method, mirrorURL.String(), bytes.NewReader(body))
+					if err != nil {
+						utils.Error("Mirror: cannot create request for route " + route.Name, err)
+						pushMirrorMetrics(route, "error")
+						return
+					}
+					mirrorReq.Header = header
+					if targetURL.Scheme != "unix" {
+						mirrorReq.Host = targetURL.Host
+					}
+
+					resp, err := client.Do(mirrorReq)
+					if err != nil {
+						utils.Debug("Mirror: request to " + config.Target + " for route " + route.Name + " failed: " + err.Error())
+						pushMirrorMetrics(route, "error")
+						return
+					}
+					io.Copy(io.Discard, io.LimitReader(resp.Body, maxBodySize))
+					resp.Body.Close()
+
+					if resp.StatusCode >= 500 {
+						pushMirrorMetrics(route, "error")
+					} else {
+						pushMirrorMetrics(route, "success")
+					}
+				}()
+			default:
+				pushMirrorMetrics(route, "dropped")
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
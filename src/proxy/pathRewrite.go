@@ -0,0 +1,304 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/aseracorp/resiOS/src/utils"
+)
+
+// max size of the beginning of an HTML page searched for a <base> tag
+const baseHrefMaxBuffer = 64 * 1024
+
+var baseHrefRegex = regexp.MustCompile(`(?i)(<base\s[^>]*?href\s*=\s*["'])([^"']*)(["'])`)
+
+type pathRewriteRule struct {
+	match *regexp.Regexp
+	replace string
+}
+
+type pathMappingCtxKey struct{}
+
+// pathMapping links the path requested by the user and the one sent to the backend
+type pathMapping struct {
+	publicPath string
+	backendPath string
+}
+
+func compilePathRewrites(route utils.ProxyRouteConfig) []pathRewriteRule {
+	rules := []pathRewriteRule{}
+
+	for _, rewrite := range route.PathRewrites {
+		match, err := regexp.Compile(rewrite.Match)
+		if err != nil {
+			utils.Error("Path rewrite: invalid regex " + rewrite.Match + " on route " + route.Name, err)
+			continue
+		}
+
+		rules = append(rules, pathRewriteRule{
+			match: match,
+			replace: rewrite.Replace,
+		})
+	}
+
+	return rules
+}
+
+// PathRewriteMiddleware rewrites the path sent to the backend, it has to be the last stage before the proxy
+func PathRewriteMiddleware(route utils.ProxyRouteConfig) func(http.Handler) http.Handler {
+	rules := compilePathRewrites(route)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for _, rule := range rules {
+				if rule.match.MatchString(r.URL.Path) {
+					rewritten := rule.match.ReplaceAllString(r.URL.Path, rule.replace)
+					if !strings.HasPrefix(rewritten, "/") {
+						rewritten = "/" + rewritten
+					}
+
+					utils.Debug("Path rewrite: " + r.URL.Path + " -> " + rewritten + " on route " + route.Name)
+					r.URL.Path = rewritten
+					r.URL.RawPath = ""
+					break
+				}
+			}
+
+			if mapping, ok := r.Context().Value(pathMappingCtxKey{}).(*pathMapping); ok {
+				mapping.backendPath = r.URL.Path
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// pathPrefixes returns the part of the public path replaced by the backend path,
+// ex: /app/v2/x sent as /api/x gives /app/v2/ and /api/
+func pathPrefixes(publicPath, backendPath string) (string, string, bool) {
+	i, j := len(publicPath), len(backendPath)
+	for i > 0 && j > 0 && publicPath[i-1] == backendPath[j-1] {
+		i--
+		j--
+	}
+
+	// only map whole path segments
+	slash := strings.Index(publicPath[i:], "/")
+	if slash < 0 {
+		return "", "", false
+	}
+
+	publicPrefix := publicPath[:i+slash] + "/"
+	backendPrefix := backendPath[:j+slash] + "/"
+
+	return publicPrefix, backendPrefix, publicPrefix != backendPrefix
+}
+
+type pathResponseRewriter struct {
+	route utils.ProxyRouteConfig
+	upstreamHosts map[string]bool
+}
+
+// rewriteURL maps a URL sent by the backend (Location, base href) back to the public path
+func (rw *pathResponseRewriter) rewriteURL(location string, r *http.Request, publicPrefix, backendPrefix string) string {
+	parsed, err := url.Parse(location)
+	if err != nil {
+		return location
+	}
+
+	if parsed.Host != "" {
+		if !rw.upstreamHosts[parsed.Host] && parsed.Host != r.Host {
+			// redirect to another website
+			return location
+		}
+
+		if rw.upstreamHosts[parsed.Host] {
+			parsed.Scheme = "http"
+			if utils.IsHTTPS {
+				parsed.Scheme = "https"
+			}
+			parsed.Host = r.Host
+		}
+	} else if !strings.HasPrefix(parsed.Path, "/") {
+		// relative URLs are already right
+		return location
+	}
+
+	if strings.HasPrefix(parsed.Path, publicPrefix) && strings.HasPrefix(publicPrefix, backendPrefix) {
+		// the backend already knows where it is hosted
+	} else if strings.HasPrefix(parsed.Path, backendPrefix) {
+		parsed.Path = publicPrefix + parsed.Path[len(backendPrefix):]
+		parsed.RawPath = ""
+	} else if parsed.Path == strings.TrimSuffix(backendPrefix, "/") {
+		parsed.Path = strings.TrimSuffix(publicPrefix, "/")
+		parsed.RawPath = ""
+	}
+
+	return parsed.String()
+}
+
+type pathResponseWriter struct {
+	http.ResponseWriter
+	rewriter *pathResponseRewriter
+	r *http.Request
+	mapping *pathMapping
+	publicPrefix string
+	backendPrefix string
+	status int
+	wroteHeader bool
+	buffering bool
+	buffer bytes.Buffer
+	hijacked bool
+}
+
+func (w *pathResponseWriter) WriteHeader(status int) {
+	if status < 200 && status != http.StatusSwitchingProtocols {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	w.status = status
+
+	publicPrefix, backendPrefix, ok := pathPrefixes(w.mapping.publicPath, w.mapping.backendPath)
+	if !ok {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	w.publicPrefix = publicPrefix
+	w.backendPrefix = backendPrefix
+
+	header := w.Header()
+
+	if w.rewriter.route.RewriteLocation {
+		if location := header.Get("Location"); location != "" {
+			rewritten := w.rewriter.rewriteURL(location, w.r, publicPrefix, backendPrefix)
+			utils.Debug("Path rewrite: Location " + location + " -> " + rewritten)
+			header.Set("Location", rewritten)
+		}
+	}
+
+	contentEncoding := header.Get("Content-Encoding")
+	isHTML := strings.HasPrefix(strings.ToLower(header.Get("Content-Type")), "text/html")
+
+	if w.rewriter.route.RewriteBaseHref && status == http.StatusOK && isHTML && (contentEncoding == "" || contentEncoding == "identity") {
+		w.buffering = true
+		header.Del("Content-Length")
+		return
+	}
+
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *pathResponseWriter) flushBuffer() error {
+	w.buffering = false
+
+	body := baseHrefRegex.ReplaceAllFunc(w.buffer.Bytes(), func(tag []byte) []byte {
+		parts := baseHrefRegex.FindSubmatch(tag)
+		href := w.rewriter.rewriteURL(string(parts[2]), w.r, w.publicPrefix, w.backendPrefix)
+		return append(append(append([]byte{}, parts[1]...), href...), parts[3]...)
+	})
+	w.buffer = bytes.Buffer{}
+
+	w.ResponseWriter.WriteHeader(w.status)
+	_, err := w.ResponseWriter.Write(body)
+	return err
+}
+
+func (w *pathResponseWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	if !w.buffering {
+		return w.ResponseWriter.Write(p)
+	}
+
+	w.buffer.Write(p)
+	if w.buffer.Len() >= baseHrefMaxBuffer || bytes.Contains(bytes.ToLower(w.buffer.Bytes()), []byte("</head>")) {
+		if err := w.flushBuffer(); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(p), nil
+}
+
+func (w *pathResponseWriter) Flush() {
+	if w.hijacked {
+		return
+	}
+
+	if w.buffering {
+		w.flushBuffer()
+	}
+
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *pathResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	w.hijacked = true
+	return hijacker.Hijack()
+}
+
+func (w *pathResponseWriter) Close() {
+	if !w.hijacked && w.buffering {
+		w.flushBuffer()
+	}
+}
+
+// PathResponseRewriteMiddleware maps the Location headers and <base href> sent by the backend
+// back to the public path, so apps hosted in a sub-path work without configuration
+func PathResponseRewriteMiddleware(route utils.ProxyRouteConfig) func(http.Handler) http.Handler {
+	rewriter := &pathResponseRewriter{
+		route: route,
+		upstreamHosts: map[string]bool{},
+	}
+
+	for _, target := range GetRouteTargets(route) {
+		if targetURL, err := url.Parse(target.Target); err == nil && targetURL.Host != "" {
+			rewriter.upstreamHosts[targetURL.Host] = true
+		}
+	}
+	if route.OverwriteHostHeader != "" {
+		rewriter.upstreamHosts[route.OverwriteHostHeader] = true
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mapping := &pathMapping{
+				publicPath: r.URL.Path,
+			}
+			r = r.WithContext(context.WithValue(r.Context(), pathMappingCtxKey{}, mapping))
+
+			// pages have to be readable to rewrite them, Cosmos compresses them again if enabled
+			if route.RewriteBaseHref && strings.Contains(r.Header.Get("Accept"), "text/html") {
+				r.Header.Del("Accept-Encoding")
+			}
+
+			writer := &pathResponseWriter{
+				ResponseWriter: w,
+				rewriter: rewriter,
+				r: r,
+				mapping: mapping,
+			}
+			defer writer.Close()
+
+			next.ServeHTTP(writer, r)
+		})
+	}
+}
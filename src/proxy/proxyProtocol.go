@@ -0,0 +1,250 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aseracorp/resiOS/src/utils"
+)
+
+// PROXY protocol, see https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt
+
+var proxyProtocolV2Signature = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+
+const proxyProtocolV1MaxLength = 107
+
+// parseProxyProtocolV1 reads "PROXY TCP4 <src> <dst> <srcport> <dstport>\r\n", UNKNOWN returns a nil address
+func parseProxyProtocolV1(reader *bufio.Reader) (net.Addr, error) {
+	line := []byte{}
+	for len(line) < proxyProtocolV1MaxLength {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("PROXY protocol v1 header is too long")
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, errors.New("invalid PROXY protocol v1 header")
+	}
+
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil || port < 0 || port > 65535 {
+		return nil, errors.New("invalid PROXY protocol v1 source address")
+	}
+
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+// parseProxyProtocolV2 reads the binary header, LOCAL commands and unsupported families return a nil address
+func parseProxyProtocolV2(reader *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+
+	if header[12] >> 4 != 2 {
+		return nil, errors.New("unsupported PROXY protocol version")
+	}
+
+	length := int(binary.BigEndian.Uint16(header[14:16]))
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, err
+	}
+
+	// LOCAL: health checks of the load balancer itself
+	if header[12] & 0x0F == 0 {
+		return nil, nil
+	}
+
+	switch header[13] >> 4 {
+	case 1:
+		if length < 12 {
+			return nil, errors.New("truncated PROXY protocol v2 IPv4 address")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}, nil
+	case 2:
+		if length < 36 {
+			return nil, errors.New("truncated PROXY protocol v2 IPv6 address")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}, nil
+	}
+
+	return nil, nil
+}
+
+// readProxyProtocolHeader returns the client address announced by the header, nil if there is none
+func readProxyProtocolHeader(reader *bufio.Reader) (net.Addr, error) {
+	peek, err := reader.Peek(len(proxyProtocolV2Signature))
+	if err == nil && bytes.Equal(peek, proxyProtocolV2Signature) {
+		return parseProxyProtocolV2(reader)
+	}
+
+	// the header is optional, a trusted source can also connect directly
+	peek, err = reader.Peek(6)
+	if err == nil && string(peek) == "PROXY " {
+		return parseProxyProtocolV1(reader)
+	}
+
+	return nil, nil
+}
+
+// WriteProxyProtocolHeader announces the client address to an upstream, version is v1 or v2
+func WriteProxyProtocolHeader(w io.Writer, version string, source net.Addr, destination net.Addr) error {
+	src, srcOk := source.(*net.TCPAddr)
+	dst, dstOk := destination.(*net.TCPAddr)
+
+	if version == utils.ProxyProtocolVersionList["v2"] {
+		header := append([]byte{}, proxyProtocolV2Signature...)
+		if !srcOk || !dstOk {
+			// LOCAL, no address
+			header = append(header, 0x20, 0x00, 0x00, 0x00)
+			_, err := w.Write(header)
+			return err
+		}
+
+		var addresses []byte
+		if src.IP.To4() != nil && dst.IP.To4() != nil {
+			header = append(header, 0x21, 0x11)
+			addresses = append(append(addresses, src.IP.To4()...), dst.IP.To4()...)
+		} else {
+			header = append(header, 0x21, 0x21)
+			addresses = append(append(addresses, src.IP.To16()...), dst.IP.To16()...)
+		}
+		addresses = binary.BigEndian.AppendUint16(addresses, uint16(src.Port))
+		addresses = binary.BigEndian.AppendUint16(addresses, uint16(dst.Port))
+
+		header = binary.BigEndian.AppendUint16(header, uint16(len(addresses)))
+		_, err := w.Write(append(header, addresses...))
+		return err
+	}
+
+	if !srcOk || !dstOk {
+		_, err := io.WriteString(w, "PROXY UNKNOWN\r\n")
+		return err
+	}
+
+	family := "TCP6"
+	if src.IP.To4() != nil && dst.IP.To4() != nil {
+		family = "TCP4"
+	}
+
+	_, err := io.WriteString(w, "PROXY " + family + " " + src.IP.String() + " " + dst.IP.String() + " " +
+		strconv.Itoa(src.Port) + " " + strconv.Itoa(dst.Port) + "\r\n")
+	return err
+}
+
+// proxyProtocolConn reads the header lazily so a slow client does not block Accept
+type proxyProtocolConn struct {
+	net.Conn
+	reader *bufio.Reader
+	trusted bool
+	once sync.Once
+	remoteAddr net.Addr
+	err error
+}
+
+func (c *proxyProtocolConn) readHeader() {
+	c.once.Do(func() {
+		if !c.trusted {
+			return
+		}
+
+		c.Conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+		addr, err := readProxyProtocolHeader(c.reader)
+		c.Conn.SetReadDeadline(time.Time{})
+
+		if err != nil {
+			utils.Warn("PROXY protocol: invalid header from " + c.Conn.RemoteAddr().String() + ": " + err.Error())
+			c.err = err
+			return
+		}
+		if addr != nil {
+			c.remoteAddr = addr
+		}
+	})
+}
+
+func (c *proxyProtocolConn) Read(p []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(p)
+}
+
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// ProxyProtocolListener accepts PROXY protocol headers from the trusted sources only
+type ProxyProtocolListener struct {
+	net.Listener
+	trusted []*net.IPNet
+}
+
+// NewProxyProtocolListener trusts nobody when the list is empty, the headers are then never read
+func NewProxyProtocolListener(listener net.Listener, trustedIPs []string) *ProxyProtocolListener {
+	trusted := utils.ParseCIDRList(trustedIPs)
+
+	if len(trusted) == 0 {
+		utils.Error("PROXY protocol: no trusted source configured on " + listener.Addr().String() + ", set ProxyProtocolTrustedIPs to the addresses of your load balancer. PROXY headers are ignored", nil)
+	}
+
+	return &ProxyProtocolListener{
+		Listener: listener,
+		trusted: trusted,
+	}
+}
+
+func (l *ProxyProtocolListener) isTrusted(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+
+	for _, ipNet := range l.trusted {
+		if ipNet.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *ProxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	return &proxyProtocolConn{
+		Conn: conn,
+		reader: bufio.NewReader(conn),
+		trusted: l.isTrusted(conn.RemoteAddr()),
+	}, nil
+}
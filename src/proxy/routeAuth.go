@@ -0,0 +1,378 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/aseracorp/resiOS/src/utils"
+)
+
+// verified credentials are kept for a while, bcrypt and the delay of CheckLoginPassword
+// on every request would be too slow for API clients
+const routeAuthCacheTTL = 5 * time.Minute
+
+// routeAuthIdentity is who the Authorization header belongs to.
+// Route scoped identities (route credentials, tokens) are valid for their route only, admin only included
+type routeAuthIdentity struct {
+	Nickname string
+	Role utils.Role
+	RouteScoped bool
+	expires time.Time
+}
+
+var routeAuthCache = map[string]routeAuthIdentity{}
+var routeAuthCacheLock sync.Mutex
+
+func routeAuthCacheKey(routeName string, username string, password string) string {
+	hash := sha256.Sum256([]byte(routeName + "\x00" + username + "\x00" + password))
+	return hex.EncodeToString(hash[:])
+}
+
+func getCachedRouteAuth(key string) (routeAuthIdentity, bool) {
+	routeAuthCacheLock.Lock()
+	defer routeAuthCacheLock.Unlock()
+
+	identity, ok := routeAuthCache[key]
+	if !ok || time.Now().After(identity.expires) {
+		return routeAuthIdentity{}, false
+	}
+	return identity, true
+}
+
+func setCachedRouteAuth(key string, identity routeAuthIdentity) {
+	routeAuthCacheLock.Lock()
+	defer routeAuthCacheLock.Unlock()
+
+	if len(routeAuthCache) > 1000 {
+		now := time.Now()
+		for k, cached := range routeAuthCache {
+			if now.After(cached.expires) {
+				delete(routeAuthCache, k)
+			}
+		}
+	}
+
+	identity.expires = time.Now().Add(routeAuthCacheTTL)
+	routeAuthCache[key] = identity
+}
+
+// HashBearerToken is what is stored in the config instead of the token
+func HashBearerToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+func hasRouteCredentials(route utils.ProxyRouteConfig) bool {
+	return route.BasicAuth.Enabled || len(route.BearerTokens) > 0
+}
+
+// checkBasicAuth goes through the same protection as the login page, route users are counted as route/username
+func checkBasicAuth(route utils.ProxyRouteConfig, r *http.Request, username string, password string) (routeAuthIdentity, error) {
+	config := route.BasicAuth
+
+	key := routeAuthCacheKey(route.Name, username, password)
+	if identity, ok := getCachedRouteAuth(key); ok {
+		return identity, nil
+	}
+
+	routeUser := route.Name + "/" + username
+
+	if hash, ok := config.Users[username]; ok {
+		if delay := utils.LoginDelay(routeUser, utils.GetClientIP(r)); delay > 0 {
+			time.Sleep(delay)
+		}
+
+		if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)); err != nil {
+			utils.RecordLoginFailure(r, routeUser, false)
+			return routeAuthIdentity{}, errors.New("invalid password for route user " + username)
+		}
+
+		utils.ClearLoginFailures(routeUser, "")
+
+		identity := routeAuthIdentity{
+			Nickname: username,
+			Role: utils.USER,
+			RouteScoped: true,
+		}
+		setCachedRouteAuth(key, identity)
+		return identity, nil
+	}
+
+	if !config.CosmosUsers {
+		utils.RecordLoginFailure(r, routeUser, false)
+		return routeAuthIdentity{}, errors.New("unknown route user " + username)
+	}
+
+	nickname := utils.Sanitize(username)
+	if err := utils.CheckLoginPassword(r, nickname, password); err != nil {
+		return routeAuthIdentity{}, errors.New("invalid credentials for user " + nickname)
+	}
+
+	c, closeDb, errCo := utils.GetEmbeddedCollection(utils.GetRootAppId(), "users")
+	defer closeDb()
+	if errCo != nil {
+		return routeAuthIdentity{}, errCo
+	}
+
+	user := utils.User{}
+	err := c.FindOne(nil, map[string]interface{}{
+		"Nickname": nickname,
+	}).Decode(&user)
+	if err != nil {
+		return routeAuthIdentity{}, err
+	}
+
+	// a password alone is not enough for these accounts
+	if (user.MFAKey != "" && user.Was2FAVerified) || utils.GetMainConfig().RequireMFA {
+		return routeAuthIdentity{}, errors.New("user " + nickname + " needs MFA and cannot use basic auth")
+	}
+
+	identity := routeAuthIdentity{
+		Nickname: user.Nickname,
+		Role: user.Role,
+	}
+	setCachedRouteAuth(key, identity)
+	return identity, nil
+}
+
+func checkBearerToken(route utils.ProxyRouteConfig, token string) (routeAuthIdentity, error) {
+	hash := []byte(HashBearerToken(token))
+
+	for _, bearer := range route.BearerTokens {
+		if subtle.ConstantTimeCompare(hash, []byte(bearer.Hash)) != 1 {
+			continue
+		}
+
+		if !bearer.ExpiresAt.IsZero() && time.Now().After(bearer.ExpiresAt) {
+			return routeAuthIdentity{}, errors.New("token " + bearer.Name + " expired")
+		}
+
+		return routeAuthIdentity{
+			Nickname: "token:" + bearer.Name,
+			Role: utils.USER,
+			RouteScoped: true,
+		}, nil
+	}
+
+	return routeAuthIdentity{}, errors.New("unknown token")
+}
+
+// authenticateRouteRequest reads the Authorization header, handled is false if it is not meant for Cosmos
+func authenticateRouteRequest(route utils.ProxyRouteConfig, r *http.Request) (identity routeAuthIdentity, handled bool, err error) {
+	authorization := r.Header.Get("Authorization")
+	scheme, credentials, _ := strings.Cut(authorization, " ")
+
+	if strings.EqualFold(scheme, "Basic") && route.BasicAuth.Enabled {
+		username, password, ok := r.BasicAuth()
+		if !ok {
+			return routeAuthIdentity{}, true, errors.New("malformed basic auth header")
+		}
+		identity, err := checkBasicAuth(route, r, username, password)
+		return identity, true, err
+	}
+
+	if strings.EqualFold(scheme, "Bearer") && len(route.BearerTokens) > 0 {
+		identity, err := checkBearerToken(route, strings.TrimSpace(credentials))
+		if err != nil {
+			// a wrong token counts towards the failures of the IP, like a wrong password
+			utils.RecordLoginFailure(r, route.Name + "/token", false)
+		}
+		return identity, true, err
+	}
+
+	return routeAuthIdentity{}, false, nil
+}
+
+func writeRouteAuthChallenge(w http.ResponseWriter, route utils.ProxyRouteConfig) {
+	if route.BasicAuth.Enabled {
+		realm := route.BasicAuth.Realm
+		if realm == "" {
+			realm = route.Name
+		}
+		w.Header().Set("WWW-Authenticate", "Basic realm=" + strconv.Quote(realm) + ", charset=\"UTF-8\"")
+	} else {
+		w.Header().Set("WWW-Authenticate", "Bearer realm=" + strconv.Quote(route.Name))
+	}
+	utils.HTTPError(w, "Unauthorized", http.StatusUnauthorized, "HTTP004")
+}
+
+type RouteTokenJSON struct {
+	Name string `json:"name"`
+	CreatedAt time.Time `json:"createdAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	Expired bool `json:"expired"`
+}
+
+type CreateRouteTokenRequestJSON struct {
+	Route string `json:"route" validate:"required"`
+	Name string `json:"name" validate:"required"`
+	// days, the token never expires if 0
+	ExpiresIn int `json:"expiresIn"`
+}
+
+type DeleteRouteTokenRequestJSON struct {
+	Route string `json:"route" validate:"required"`
+	Name string `json:"name" validate:"required"`
+}
+
+func generateBearerToken() (string, error) {
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		return "", err
+	}
+	return "cosmos_" + base64.RawURLEncoding.EncodeToString(token), nil
+}
+
+// API_RouteTokens lists, creates and revokes the bearer tokens of a route
+func API_RouteTokens(w http.ResponseWriter, req *http.Request) {
+	if utils.AdminOnly(w, req) != nil {
+		return
+	}
+
+	if(req.Method == "GET") {
+		routeName := req.URL.Query().Get("route")
+		tokens := []RouteTokenJSON{}
+
+		for _, route := range utils.GetMainConfig().HTTPConfig.ProxyConfig.Routes {
+			if route.Name != routeName {
+				continue
+			}
+			for _, token := range route.BearerTokens {
+				tokens = append(tokens, RouteTokenJSON{
+					Name: token.Name,
+					CreatedAt: token.CreatedAt,
+					ExpiresAt: token.ExpiresAt,
+					Expired: !token.ExpiresAt.IsZero() && time.Now().After(token.ExpiresAt),
+				})
+			}
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "OK",
+			"data": tokens,
+		})
+		return
+	}
+
+	if req.Method != "POST" && req.Method != "DELETE" {
+		utils.Error("RouteTokens: Method not allowed" + req.Method, nil)
+		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
+		return
+	}
+
+	var routeName, tokenName string
+	var expiresIn int
+
+	if req.Method == "POST" {
+		var request CreateRouteTokenRequestJSON
+		err := json.NewDecoder(req.Body).Decode(&request)
+		if err != nil || request.Route == "" || request.Name == "" || request.ExpiresIn < 0 {
+			utils.Error("RouteTokens: Invalid User Request", err)
+			utils.HTTPError(w, "Invalid request", http.StatusBadRequest, "HTTP001")
+			return
+		}
+		routeName, tokenName, expiresIn = request.Route, request.Name, request.ExpiresIn
+	} else {
+		var request DeleteRouteTokenRequestJSON
+		err := json.NewDecoder(req.Body).Decode(&request)
+		if err != nil || request.Route == "" || request.Name == "" {
+			utils.Error("RouteTokens: Invalid User Request", err)
+			utils.HTTPError(w, "Invalid request", http.StatusBadRequest, "HTTP001")
+			return
+		}
+		routeName, tokenName = request.Route, request.Name
+	}
+
+	utils.ConfigLock.Lock()
+	defer utils.ConfigLock.Unlock()
+
+	config := utils.ReadConfigFromFile()
+	routes := config.HTTPConfig.ProxyConfig.Routes
+
+	routeIndex := -1
+	for i, route := range routes {
+		if route.Name == routeName {
+			routeIndex = i
+			break
+		}
+	}
+
+	if routeIndex == -1 {
+		utils.Error("RouteTokens: Route not found: " + routeName, nil)
+		utils.HTTPError(w, "Route not found", http.StatusNotFound, "UR002")
+		return
+	}
+
+	tokens := []utils.ProxyBearerToken{}
+	found := false
+	for _, token := range routes[routeIndex].BearerTokens {
+		if token.Name == tokenName {
+			found = true
+			continue
+		}
+		tokens = append(tokens, token)
+	}
+
+	result := ""
+
+	if req.Method == "POST" {
+		if found {
+			utils.Error("RouteTokens: Token already exists: " + tokenName, nil)
+			utils.HTTPError(w, "A token with this name already exists", http.StatusConflict, "HTTP001")
+			return
+		}
+
+		token, err := generateBearerToken()
+		if err != nil {
+			utils.Error("RouteTokens: Cannot generate token", err)
+			utils.HTTPError(w, "Cannot generate token", http.StatusInternalServerError, "HTTP001")
+			return
+		}
+
+		bearer := utils.ProxyBearerToken{
+			Name: tokenName,
+			Hash: HashBearerToken(token),
+			CreatedAt: time.Now(),
+		}
+		if expiresIn > 0 {
+			bearer.ExpiresAt = time.Now().AddDate(0, 0, expiresIn)
+		}
+
+		tokens = append(tokens, bearer)
+		result = token
+
+		utils.Log("RouteTokens: Created token " + tokenName + " for route " + routeName)
+	} else {
+		if !found {
+			utils.Error("RouteTokens: Token not found: " + tokenName, nil)
+			utils.HTTPError(w, "Token not found", http.StatusNotFound, "HTTP002")
+			return
+		}
+
+		utils.Log("RouteTokens: Revoked token " + tokenName + " of route " + routeName)
+	}
+
+	routes[routeIndex].BearerTokens = tokens
+	config.HTTPConfig.ProxyConfig.Routes = routes
+	utils.SetBaseMainConfig(config)
+
+	go utils.RestartHTTPServer()
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": "OK",
+		// only returned once
+		"data": result,
+	})
+}
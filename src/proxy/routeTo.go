@@ -5,13 +5,11 @@ import (
 	"net/http/httputil" 
 	"net/url"
 	"strings"
-	"crypto/tls"
 	"os"
 	"io/ioutil"
 	"strconv"
-	"time"
 	"context"
-	"net"
+	"errors"
 
 	"github.com/aseracorp/resiOS/src/utils"
 	"github.com/aseracorp/resiOS/src/docker"
@@ -52,52 +50,35 @@ func joinURLPath(a, b *url.URL) (path, rawpath string) {
 }
 
 
-// NewProxy takes target host and creates a reverse proxy
-func NewProxy(targetHost string, AcceptInsecureHTTPSTarget bool, DisableHeaderHardening bool, route utils.ProxyRouteConfig) (*httputil.ReverseProxy, error) {
-	var transport http.RoundTripper
-	var targetURL *url.URL
-	var err error
-
-	// if strings.HasPrefix(targetHost, "http://unix://") {
-	// 	// Unix socket handling
-	// 	socketPath := strings.TrimPrefix(targetHost, "http://unix://")
-	// 	transport = &http.Transport{
-	// 		DialContext: func(_ context.Context, _, _ string) (net.Conn, error) {
-	// 			return net.Dial("unix", socketPath)
-	// 		},
-	// 	}
-	// 	// Use a dummy URL for the director
-	// 	targetURL, _ = url.Parse("http://unix-socket")
-	// } else {
-		// Regular HTTP/HTTPS handling
-		targetURL, err = url.Parse(targetHost)
+// getUpstreamHost returns the host to reach a target, resolving the container IP for SERVAPP when Cosmos is not in the docker network
+func getUpstreamHost(route utils.ProxyRouteConfig, targetURL *url.URL) string {
+	if route.Mode == "SERVAPP" && (!utils.IsInsideContainer || utils.IsHostNetwork) {
+		targetHost := targetURL.Hostname()
+
+		targetIP, err := docker.GetContainerIPByName(targetHost)
 		if err != nil {
-			return nil, err
+			utils.Error("Create Route", err)
 		}
+		utils.Debug("Dockerless Target IP: " + targetIP)
+		return targetIP + ":" + targetURL.Port()
+	}
 
-		customTransport := &http.Transport{}
-
-		if utils.GetMainConfig().ConstellationConfig.Enabled && utils.GetMainConfig().ConstellationConfig.SlaveMode {
-			customTransport = &http.Transport{
-				DialContext: (&net.Dialer{
-					Timeout:   5 * time.Second,
-					KeepAlive: 5 * time.Second,
-					Resolver: &net.Resolver{
-						PreferGo: true,
-						Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
-							return net.Dial(network, "192.168.201.1:53")
-						},
-					},
-				}).DialContext,
-			}
-		}
+	return targetURL.Host
+}
 
-		if AcceptInsecureHTTPSTarget {
-			customTransport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
-		}
+// NewProxy takes target host and creates a reverse proxy
+func NewProxy(targetHost string, AcceptInsecureHTTPSTarget bool, DisableHeaderHardening bool, route utils.ProxyRouteConfig) (*httputil.ReverseProxy, error) {
+	targetURL, err := url.Parse(normalizeTarget(targetHost))
+	if err != nil {
+		return nil, err
+	}
 
-		transport = customTransport
-	// }
+	isUnixSocket := targetURL.Scheme == "unix"
+
+	transport, targetURL, err := newUpstreamTransport(targetURL, AcceptInsecureHTTPSTarget, route)
+	if err != nil {
+		return nil, err
+	}
 
 	proxy := &httputil.ReverseProxy{
 		Transport: transport,
@@ -111,17 +92,10 @@ func NewProxy(targetHost string, AcceptInsecureHTTPSTarget bool, DisableHeaderHa
 		
 		urlQuery := targetURL.RawQuery
 		req.URL.Scheme = targetURL.Scheme
-		req.URL.Host = targetURL.Host
-		
-		if route.Mode == "SERVAPP" && (!utils.IsInsideContainer || utils.IsHostNetwork) {
-			targetHost := targetURL.Hostname()
-
-			targetIP, err := docker.GetContainerIPByName(targetHost)
-			if err != nil {
-				utils.Error("Create Route", err)
-			}
-			utils.Debug("Dockerless Target IP: " + targetIP)
-			req.URL.Host = targetIP + ":" + targetURL.Port()
+		if isUnixSocket {
+			req.URL.Host = targetURL.Host
+		} else {
+			req.URL.Host = getUpstreamHost(route, targetURL)
 		}
 
 		utils.Debug("Request to backend: " + req.URL.String())
@@ -194,6 +168,29 @@ func NewProxy(targetHost string, AcceptInsecureHTTPSTarget bool, DisableHeaderHa
 
 	proxy.Transport = transport
 
+	if getUpstreamProtocol(route) == "GRPC" {
+		// streams have to be sent as they come
+		proxy.FlushInterval = -1
+	}
+
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		if errors.Is(err, context.Canceled) {
+			// the client went away, nobody to answer to
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+
+		utils.Error("Proxy: cannot reach backend of route " + route.Name, err)
+
+		if isGRPCRequest(r) {
+			// 14 is UNAVAILABLE
+			writeGRPCError(w, 14, "backend of route " + route.Name + " is not reachable")
+			return
+		}
+
+		ServeErrorPage(w, r, route.Name, http.StatusBadGateway, "502 Bad Gateway. This means your container / backend is not reachable by Cosmos.")
+	}
+
 	proxy.ModifyResponse = func(resp *http.Response) error {
 		utils.Debug("Response from backend: " + resp.Status)
 		utils.Debug("URL was " + resp.Request.URL.String())
@@ -235,13 +232,8 @@ func RouteTo(route utils.ProxyRouteConfig) http.Handler {
 	}
 
   if(routeType == "SERVAPP" || routeType == "PROXY") {
-		proxy, err := NewProxy(destination, route.AcceptInsecureHTTPSTarget, route.DisableHeaderHardening, route)
-		if err != nil {
-				utils.Error("Create Route", err)
-		}
-
-		// create a handler function which uses the reverse proxy
-		return proxy
+		// create a handler which spreads the requests across the reverse proxies
+		return NewLoadBalancer(route)
 	}  else if (routeType == "STATIC") {
 		return http.FileServer(http.Dir(destination))
 	}  else if (routeType == "SPA") {
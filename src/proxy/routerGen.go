@@ -5,7 +5,7 @@ import (
 	"regexp"
 	"strconv"
 	"time"
-	"net/url"
+	"strings"
 
 	"github.com/aseracorp/resiOS/src/user"
 	"github.com/aseracorp/resiOS/src/constellation"
@@ -14,10 +14,23 @@ import (
 	"github.com/gorilla/mux"
 )
 
+var cosmosTokenCookieRegexp = regexp.MustCompile(`\s?jwttoken=[^;]*;?\s?`)
+
+// removeCosmosTokenCookie keeps the Cosmos session away from the backends
+func removeCosmosTokenCookie(r *http.Request) {
+	ogcookies := r.Header.Get("Cookie")
+	if ogcookies == "" {
+		return
+	}
+	cookies := cosmosTokenCookieRegexp.ReplaceAllString(ogcookies, "")
+	r.Header.Set("Cookie", cookies)
+}
+
 func tokenMiddleware(route utils.ProxyRouteConfig) func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			enabled := route.AuthEnabled
+			// basic auth and tokens protect the route on their own
+			enabled := route.AuthEnabled || hasRouteCredentials(route)
 			adminOnly := route.AdminOnly
 
 			// bypass auth if from Constellation tunnel
@@ -42,20 +55,50 @@ func tokenMiddleware(route utils.ProxyRouteConfig) func(next http.Handler) http.
 			r.Header.Del("x-cosmos-mfa")
 			r.Header.Del("x-cstln-auth")
 
+			if hasRouteCredentials(route) {
+				identity, handled, err := authenticateRouteRequest(route, r)
+				if handled {
+					if err != nil {
+						utils.Warn("Route " + route.Name + ": authentication failed from " + utils.GetClientIP(r) + ": " + err.Error())
+						writeRouteAuthChallenge(w, route)
+						return
+					}
+
+					if adminOnly && !identity.RouteScoped && identity.Role < utils.ADMIN {
+						utils.Error("Route " + route.Name + ": " + identity.Nickname + " is not an admin", nil)
+						utils.HTTPError(w, "User not Authorized", http.StatusUnauthorized, "HTTP004")
+						return
+					}
+
+					// the credentials are for Cosmos, not for the backend
+					r.Header.Del("Authorization")
+					removeCosmosTokenCookie(r)
+					r.Header.Set("x-cosmos-user", identity.Nickname)
+					r.Header.Set("x-cosmos-role", strconv.Itoa((int)(identity.Role)))
+					r.Header.Set("x-cosmos-mfa", "0")
+
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+
 			u, err := user.RefreshUserToken(w, r)
 
 			if err != nil {
 				return
 			}
 
+			// machine clients get a challenge instead of the login page
+			if enabled && u.Nickname == "" && hasRouteCredentials(route) && !acceptsHTML(r) {
+				writeRouteAuthChallenge(w, route)
+				return
+			}
+
 			r.Header.Set("x-cosmos-user", u.Nickname)
 			r.Header.Set("x-cosmos-role", strconv.Itoa((int)(u.Role)))
 			r.Header.Set("x-cosmos-mfa", strconv.Itoa((int)(u.MFAState)))
 
-			ogcookies := r.Header.Get("Cookie")
-			cookieRemoveRegex := regexp.MustCompile(`\s?jwttoken=[^;]*;?\s?`)
-			cookies := cookieRemoveRegex.ReplaceAllString(ogcookies, "")
-			r.Header.Set("Cookie", cookies)
+			removeCosmosTokenCookie(r)
 
 			// Replace the token with a application speicfic one
 			//r.Header.Set("x-cosmos-token", "1234567890")
@@ -90,25 +133,26 @@ func AddConstellationToken(route utils.ProxyRouteConfig) func(next http.Handler)
 }
 
 func RouterGen(route utils.ProxyRouteConfig, router *mux.Router, destination http.Handler) *mux.Route {
+	if err := ValidateRouteTargets(route); err != nil {
+		utils.Error("Route " + route.Name + " is invalid and was not added", err)
+		utils.TriggerEvent(
+			"cosmos.proxy.route.invalid",
+			"Proxy Route " + route.Name + " is invalid",
+			"error",
+			"route@" + route.Name,
+			map[string]interface{}{
+			"route": route.Name,
+			"error": err.Error(),
+		})
+		return nil
+	}
+
 	origin := router.NewRoute()
 
 	if route.UseHost {
 		origin = origin.Host(route.Host)
-
-		if route.Mode == "SERVAP" || route.Mode == "PROXY" || route.Mode == "REDIRECT" {
-			// if Scheme is not http/https, discard
-			urlRoute, err := url.Parse(route.Target)
-			if err != nil {
-				utils.Error("Invalid target URL: "+route.Target, err)
-				return nil
-			}
-
-			if urlRoute.Scheme != "http" && urlRoute.Scheme != "https" {
-				return nil
-			}
-		}
 	}
-	
+
 	if route.UsePathPrefix {
 		if route.PathPrefix != "" && route.PathPrefix[0] != '/' {
 			utils.Error("PathPrefix must start with a /", nil)
@@ -116,6 +160,29 @@ func RouterGen(route utils.ProxyRouteConfig, router *mux.Router, destination htt
 		origin = origin.PathPrefix(route.PathPrefix)
 	}
 	
+	if route.UsePathRegex && route.PathRegex != "" {
+		pathRegex, err := regexp.Compile(route.PathRegex)
+		if err != nil {
+			utils.Error("Invalid path regex: " + route.PathRegex, err)
+			return nil
+		}
+		origin = origin.MatcherFunc(func(r *http.Request, rm *mux.RouteMatch) bool {
+			return pathRegex.MatchString(r.URL.Path)
+		})
+	}
+
+	if route.Mirror.Enabled && (route.Mode == "SERVAPP" || route.Mode == "PROXY") {
+		if route.Mirror.Target == "" {
+			utils.Error("Mirror is enabled on route " + route.Name + " but no target is set, ignoring it", nil)
+		} else {
+			destination = MirrorMiddleware(route)(destination)
+		}
+	}
+
+	if len(route.PathRewrites) > 0 || route.RewriteLocation || route.RewriteBaseHref {
+		destination = PathRewriteMiddleware(route)(destination)
+	}
+	
 	if route.UsePathPrefix && route.StripPathPrefix {
 		if route.PathPrefix != "" && route.PathPrefix[0] != '/' {
 			utils.Error("PathPrefix must start with a /", nil)
@@ -125,6 +192,32 @@ func RouterGen(route utils.ProxyRouteConfig, router *mux.Router, destination htt
 
 	destination = AddConstellationToken(route)(destination)
 
+	if route.RewriteLocation || route.RewriteBaseHref {
+		destination = PathResponseRewriteMiddleware(route)(destination)
+	}
+
+	if route.ErrorPages.Enabled {
+		destination = ErrorPagesMiddleware(route)(destination)
+	}
+
+	if route.Cache.Enabled {
+		destination = CacheMiddleware(route)(destination)
+	}
+
+	if route.Compression.Enabled {
+		destination = CompressionMiddleware(route)(destination)
+	}
+
+	if len(route.HeaderRules) > 0 {
+		destination = HeaderRulesMiddleware(route)(destination)
+	}
+
+	destination = MaintenanceMiddleware(route)(destination)
+
+	if route.AccessSchedule.Enabled {
+		destination = AccessScheduleMiddleware(route)(destination)
+	}
+
 	for filter := range route.AddionalFilters {
 		if route.AddionalFilters[filter].Type == "header" {
 			origin = origin.Headers(route.AddionalFilters[filter].Name, route.AddionalFilters[filter].Value)
@@ -147,6 +240,14 @@ func RouterGen(route utils.ProxyRouteConfig, router *mux.Router, destination htt
 		destination = utils.BlockPostWithoutReferer(destination)
 	}
 
+	if route.WAF.Enabled {
+		destination = WAFMiddleware(route)(destination)
+	}
+
+	if route.Challenge.Enabled {
+		destination = ChallengeMiddleware(route)(destination)
+	}
+
 	destination = SmartShieldMiddleware(route.Name, route)(destination)
 
 	originCORS := route.CORSOrigin
@@ -197,11 +298,30 @@ func RouterGen(route utils.ProxyRouteConfig, router *mux.Router, destination htt
 		destination = utils.SetSecurityHeaders(destination)
 	}
 
-	destination = tokenMiddleware(route)(utils.CORSHeader(originCORS)((destination)))
+	destination = utils.CORSHeader(originCORS)((destination))
+
+	if route.ForwardAuth.Enabled {
+		if route.ForwardAuth.Address == "" {
+			utils.Error("Forward auth is enabled on route " + route.Name + " but no address is set, ignoring it", nil)
+		} else {
+			destination = ForwardAuthMiddleware(route)(destination)
+		}
+	}
+
+	destination = tokenMiddleware(route)(destination)
+
+	if route.AccessLog.Enabled {
+		destination = AccessLogMiddleware(route)(destination)
+	}
 
 	origin.Handler(destination)
 
-	utils.Log("Added route: [" + (string)(route.Mode) + "] " + route.Host + route.PathPrefix + " to " + route.Target + "")
+	targets := []string{}
+	for _, target := range GetRouteTargets(route) {
+		targets = append(targets, target.Target)
+	}
+
+	utils.Log("Added route: [" + (string)(route.Mode) + "] " + route.Host + route.PathPrefix + " to " + strings.Join(targets, ", ") + "")
 
 	return origin
 }
@@ -0,0 +1,275 @@
+package proxy
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/robfig/cron/v3"
+
+	"github.com/aseracorp/resiOS/src/utils"
+)
+
+var scheduleDays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+type ScheduleStatus struct {
+	Open bool `json:"open"`
+	Timezone string `json:"timezone"`
+	// zero if the route never opens or closes in the coming week
+	NextChange time.Time `json:"nextChange"`
+}
+
+type scheduleWindow struct {
+	cron cron.Schedule
+	days map[time.Weekday]bool
+	start int // minutes since midnight
+	end int
+}
+
+// accessSchedule is the parsed ProxyAccessScheduleConfig of a route
+type accessSchedule struct {
+	location *time.Location
+	windows []scheduleWindow
+
+	// the status only changes once a minute, it is computed at most once per minute
+	statusLock sync.Mutex
+	statusMinute time.Time
+	lastStatus ScheduleStatus
+}
+
+// the schedules parsed by the middlewares, by route, reused by the status API
+var accessSchedules = map[string]*accessSchedule{}
+var accessSchedulesLock sync.Mutex
+
+func parseScheduleTime(value string) (int, error) {
+	hours, minutes, ok := strings.Cut(strings.TrimSpace(value), ":")
+	h, errH := strconv.Atoi(hours)
+	m, errM := strconv.Atoi(minutes)
+	if !ok || errH != nil || errM != nil || h < 0 || h > 24 || m < 0 || m > 59 || (h == 24 && m != 0) {
+		return 0, errors.New("invalid time " + value + ", expected HH:MM")
+	}
+	return h * 60 + m, nil
+}
+
+func parseAccessSchedule(config utils.ProxyAccessScheduleConfig) (*accessSchedule, error) {
+	schedule := &accessSchedule{
+		location: time.Local,
+	}
+
+	if config.Timezone != "" {
+		location, err := time.LoadLocation(config.Timezone)
+		if err != nil {
+			return nil, err
+		}
+		schedule.location = location
+	}
+
+	for _, window := range config.Windows {
+		if window.Cron != "" {
+			cronSchedule, err := cron.ParseStandard(window.Cron)
+			if err != nil {
+				return nil, errors.New("invalid cron expression " + window.Cron + ": " + err.Error())
+			}
+			schedule.windows = append(schedule.windows, scheduleWindow{cron: cronSchedule})
+			continue
+		}
+
+		parsed := scheduleWindow{
+			days: map[time.Weekday]bool{},
+			end: 24 * 60,
+		}
+
+		for _, day := range window.Days {
+			key := strings.ToLower(strings.TrimSpace(day))
+			if len(key) > 3 {
+				key = key[:3]
+			}
+			weekday, ok := scheduleDays[key]
+			if !ok {
+				return nil, errors.New("invalid day " + day)
+			}
+			parsed.days[weekday] = true
+		}
+
+		var err error
+		if window.Start != "" {
+			if parsed.start, err = parseScheduleTime(window.Start); err != nil {
+				return nil, err
+			}
+		}
+		if window.End != "" {
+			if parsed.end, err = parseScheduleTime(window.End); err != nil {
+				return nil, err
+			}
+		}
+
+		schedule.windows = append(schedule.windows, parsed)
+	}
+
+	return schedule, nil
+}
+
+func (window scheduleWindow) isOpen(t time.Time) bool {
+	if window.cron != nil {
+		minute := t.Truncate(time.Minute)
+		return window.cron.Next(minute.Add(-time.Second)).Equal(minute)
+	}
+
+	minutes := t.Hour() * 60 + t.Minute()
+	day := t.Weekday()
+
+	if window.start <= window.end {
+		return (len(window.days) == 0 || window.days[day]) && minutes >= window.start && minutes < window.end
+	}
+
+	// past midnight, the part after midnight belongs to the window of the day before
+	if minutes >= window.start {
+		return len(window.days) == 0 || window.days[day]
+	}
+	if minutes < window.end {
+		return len(window.days) == 0 || window.days[(day + 6) % 7]
+	}
+	return false
+}
+
+func (schedule *accessSchedule) isOpen(t time.Time) bool {
+	t = t.In(schedule.location)
+	for _, window := range schedule.windows {
+		if window.isOpen(t) {
+			return true
+		}
+	}
+	return false
+}
+
+func (schedule *accessSchedule) status(now time.Time) ScheduleStatus {
+	minute := now.Truncate(time.Minute)
+
+	schedule.statusLock.Lock()
+	defer schedule.statusLock.Unlock()
+
+	if schedule.statusMinute.Equal(minute) {
+		return schedule.lastStatus
+	}
+
+	status := ScheduleStatus{
+		Open: schedule.isOpen(now),
+		Timezone: schedule.location.String(),
+	}
+
+	// the windows have a minute resolution
+	next := minute
+	for i := 0; i < 7 * 24 * 60; i++ {
+		next = next.Add(time.Minute)
+		if schedule.isOpen(next) != status.Open {
+			status.NextChange = next
+			break
+		}
+	}
+
+	schedule.statusMinute = minute
+	schedule.lastStatus = status
+
+	return status
+}
+
+func isScheduleExempt(r *http.Request, config utils.ProxyAccessScheduleConfig) bool {
+	// headers set by the auth middleware, once the token is verified
+	nickname := r.Header.Get("x-cosmos-user")
+	role, _ := strconv.Atoi(r.Header.Get("x-cosmos-role"))
+
+	if config.ExemptRole > 0 && role >= int(config.ExemptRole) {
+		return true
+	}
+
+	for _, user := range config.ExemptUsers {
+		if nickname != "" && nickname == user {
+			return true
+		}
+	}
+
+	return false
+}
+
+// GetRouteScheduleStatus tells if the route is in one of its access windows and until when
+func GetRouteScheduleStatus(route utils.ProxyRouteConfig) (ScheduleStatus, error) {
+	accessSchedulesLock.Lock()
+	schedule, ok := accessSchedules[route.Name]
+	accessSchedulesLock.Unlock()
+	if ok {
+		return schedule.status(time.Now()), nil
+	}
+
+	schedule, err := parseAccessSchedule(route.AccessSchedule)
+	if err != nil {
+		return ScheduleStatus{}, err
+	}
+	return schedule.status(time.Now()), nil
+}
+
+func serveSchedulePage(w http.ResponseWriter, r *http.Request, route utils.ProxyRouteConfig, schedule *accessSchedule) {
+	status := schedule.status(time.Now())
+
+	message := route.AccessSchedule.Message
+	if message == "" {
+		message = "This service is not available at this time."
+		if !status.NextChange.IsZero() {
+			message += " It opens again " + status.NextChange.In(schedule.location).Format("Monday at 15:04") + "."
+		}
+	}
+
+	if !status.NextChange.IsZero() {
+		w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(status.NextChange).Seconds()) + 1))
+	}
+
+	data := newErrorPageData(r, route.Name, http.StatusForbidden, message)
+
+	renderErrorPage(w, r, route.Name, []string{"closed", "403", "4xx"}, data)
+}
+
+// AccessScheduleMiddleware only lets the requests in during the windows of the route, or from the exempted users
+func AccessScheduleMiddleware(route utils.ProxyRouteConfig) func(http.Handler) http.Handler {
+	schedule, err := parseAccessSchedule(route.AccessSchedule)
+	if err != nil {
+		// failing closed, a typo should not open a restricted route
+		utils.Error("Access schedule of route " + route.Name + " is invalid, the route is closed", err)
+		schedule = &accessSchedule{location: time.Local}
+	}
+
+	// an invalid schedule is left out, the status API parses it again to report the error
+	accessSchedulesLock.Lock()
+	if err == nil {
+		accessSchedules[route.Name] = schedule
+	} else {
+		delete(accessSchedules, route.Name)
+	}
+	accessSchedulesLock.Unlock()
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if schedule.isOpen(time.Now()) || isScheduleExempt(r, route.AccessSchedule) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			utils.Debug("Route " + route.Name + " is outside of its access schedule")
+
+			if info := getRouteRequestInfo(r); info != nil {
+				info.SetShield("schedule")
+			}
+
+			serveSchedulePage(w, r, route, schedule)
+		})
+	}
+}
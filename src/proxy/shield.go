@@ -25,16 +25,19 @@ const (
 )
 
 type UserBan struct {
-	ClientID string
-	BanType int
-	time time.Time
-	reason string
-	shieldID string
+	ID string `json:"id" bson:"_id"`
+	ClientID string `json:"clientID" bson:"ClientID"`
+	BanType int `json:"banType" bson:"BanType"`
+	Time time.Time `json:"time" bson:"Time"`
+	Reason string `json:"reason" bson:"Reason"`
+	Route string `json:"route" bson:"Route"`
 }
 
 type GlobalSmartShieldState struct {
 	sync.Mutex
 	bans []*UserBan
+	// escalation of each shield, by the route name used in the bans
+	escalations map[string]shieldEscalation
 }
 
 
@@ -74,17 +77,25 @@ func CleanUp() {
 		}
 	}
 
+	pruned := []string{}
+
 	for i := len(globalShieldState.bans) - 1; i >= 0; i-- {
 		ban := globalShieldState.bans[i]
-		if(ban.BanType == TEMP && ban.time.Add(72 * 3600 * time.Second).Before(time.Now())) {
-			globalShieldState.bans = append(globalShieldState.bans[:i], globalShieldState.bans[i+1:]...)
+		if(ban.BanType != TEMP && ban.BanType != STRIKE) {
+			continue
 		}
-		if(ban.BanType == STRIKE && ban.time.Add(72 * 3600 * time.Second).Before(time.Now())) {
+
+		escalation := globalShieldState.getBanEscalation(ban.Route)
+
+		if(ban.Time.Add(escalation.retention(ban.BanType)).Before(time.Now())) {
 			globalShieldState.bans = append(globalShieldState.bans[:i], globalShieldState.bans[i+1:]...)
+			pruned = append(pruned, ban.ID)
 		}
 	}
 
 	utils.Log("SmartShield: Cleaned up " + fmt.Sprintf("%d", shieldSize - (len(shield.requests) + len(globalShieldState.bans))) + " items")
+
+	go deleteSavedBans(pruned)
 }
 
 func (shield *smartShieldState) GetServerNbReq(shieldID string) int {
@@ -169,56 +180,17 @@ func (shield *smartShieldState) isAllowedToReqest(shieldID string, policy utils.
 
 	ClientID := userConsumed.ClientID
 
-	if ClientID == "192.168.1.1" || 
-		 ClientID == "192.168.0.1" ||
-		 ClientID == "192.168.0.254" ||
-		 ClientID == "172.17.0.1" {
+	if isShieldAllowlisted(ClientID, policy) {
 		return true
 	}
 	
-	nbTempBans := 0
-	nbStrikes := 0
-
-	// Check for bans
-	for i := len(globalShieldState.bans) - 1; i >= 0; i-- {
-		ban := globalShieldState.bans[i]
-
-		if ban.BanType == PERM && ban.ClientID == ClientID {
-			return false
-		} else if ban.BanType == TEMP && ban.ClientID == ClientID {
-			if(ban.time.Add(4 * 3600 * time.Second).After(time.Now())) {
-				return false
-			} else if (ban.time.Add(72 * 3600 * time.Second).After(time.Now())) {
-				nbTempBans++
-			}
-		} else if ban.BanType == STRIKE && ban.ClientID == ClientID {
-			if(ban.time.Add(3600 * time.Second).After(time.Now())) {
-				return false
-			} else if (ban.time.Add(24 * 3600 * time.Second).After(time.Now())) {
-				nbStrikes++
-			}
-		}
-	}
-
-	// Check for new bans
-	if nbTempBans >= 3 {
-		// perm ban
-		globalShieldState.bans = append(globalShieldState.bans, &UserBan{
-			ClientID: ClientID,
-			BanType: PERM,
-			time: time.Now(),
-		})
-
+	blocked, newBan := globalShieldState.escalateBans(ClientID, shieldID, getShieldEscalation(policy))
+	if newBan != nil && newBan.BanType == PERM {
 		utils.Warn("User " + ClientID + " has been banned permanently: "+ fmt.Sprintf("%+v", userConsumed))
-		return false
-	} else if nbStrikes >= 3 {
-		// temp ban
-		globalShieldState.bans = append(globalShieldState.bans, &UserBan{
-			ClientID: ClientID,
-			BanType: TEMP,
-			time: time.Now(),
-		})
+	} else if newBan != nil {
 		utils.Warn("User " + ClientID + " has been banned temporarily: "+ fmt.Sprintf("%+v", userConsumed))
+	}
+	if blocked {
 		return false
 	}
 
@@ -227,12 +199,11 @@ func (shield *smartShieldState) isAllowedToReqest(shieldID string, policy utils.
 		 (userConsumed.Requests > (policy.PerUserRequestLimit * policy.PolicyStrictness)) ||
 		 (userConsumed.Bytes > (policy.PerUserByteLimit * int64(policy.PolicyStrictness))) ||
 		 (userConsumed.Simultaneous > (policy.PerUserSimultaneous * policy.PolicyStrictness * 15)) {
-		globalShieldState.bans = append(globalShieldState.bans, &UserBan{
+		globalShieldState.addBan(&UserBan{
 			ClientID: ClientID,
 			BanType: STRIKE,
-			time: time.Now(),
-			reason: fmt.Sprintf("%+v out of %+v", userConsumed, policy),
-			shieldID: shieldID,
+			Reason: fmt.Sprintf("%+v out of %+v", userConsumed, policy),
+			Route: shieldID,
 		})
 		utils.Warn("User " + ClientID + " has received a strike: "+ fmt.Sprintf("%+v", userConsumed))
 		return false
@@ -296,18 +267,16 @@ func calculateLowestExhaustedPercentage(policy utils.SmartShieldPolicy, userCons
 func GetClientID(r *http.Request, route utils.ProxyRouteConfig) string {
 	// when using Docker we need to get the real IP
 	remoteAddr, _ := utils.SplitIP(r.RemoteAddr)
-	UseForwardedFor := utils.GetMainConfig().HTTPConfig.UseForwardedFor
 	isTunneledIp := constellation.GetDeviceIp(route.TunnelVia) == remoteAddr
 	isConstIP := utils.IsConstellationIP(remoteAddr)
 	isConstTokenValid := constellation.CheckConstellationToken(r) == nil
 
-	if (UseForwardedFor && r.Header.Get("x-forwarded-for") != "") || 
-		 (isTunneledIp && isConstIP && isConstTokenValid) {
-		ip, _ := utils.SplitIP(r.Header.Get("x-forwarded-for"))
-		utils.Debug("SmartShield: Getting forwarded client ID " + ip)
+	if isTunneledIp && isConstIP && isConstTokenValid {
+		ip := utils.ResolveForwardedClientIP(r)
+		utils.Debug("SmartShield: Getting tunneled client ID " + ip)
 		return ip
 	} else {
-		ip, _ := utils.SplitIP(r.RemoteAddr)
+		ip := utils.GetClientIP(r)
 		utils.Debug("SmartShield: Getting client ID " + ip)
 		return ip
 	}
@@ -320,6 +289,7 @@ func isPrivileged(req *http.Request, policy utils.SmartShieldPolicy) bool {
 
 func SmartShieldMiddleware(shieldID string, route utils.ProxyRouteConfig) func(http.Handler) http.Handler {
 	policy := route.SmartShield
+	registerBanEscalation(shieldID, policy)
 
 	if policy.Enabled {
 		if(policy.PerUserTimeBudget == 0) {
@@ -348,6 +318,7 @@ func SmartShieldMiddleware(shieldID string, route utils.ProxyRouteConfig) func(h
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			clientID := GetClientID(r, route)
+			r, info := withRouteRequestInfo(r)
 
 			wrapper := &SmartResponseWriterWrapper {
 				ResponseWriter: w,
@@ -360,6 +331,7 @@ func SmartShieldMiddleware(shieldID string, route utils.ProxyRouteConfig) func(h
 				shieldID: shieldID,
 				policy: policy,
 				isPrivileged: isPrivileged(r, policy),
+				neverBanned: isNeverBanned(r, policy),
 			}
 
 			if !policy.Enabled {
@@ -390,7 +362,7 @@ func SmartShieldMiddleware(shieldID string, route utils.ProxyRouteConfig) func(h
 					"url": r.URL,
 				})
 
-				go metrics.PushRequestMetrics(route, wrapper.Status, wrapper.TimeStarted, wrapper.Bytes)
+				go metrics.PushRequestMetrics(route, info.Upstream(), wrapper.Status, wrapper.TimeStarted, wrapper.Bytes)
 
 				return
 			}
@@ -405,6 +377,7 @@ func SmartShieldMiddleware(shieldID string, route utils.ProxyRouteConfig) func(h
 				if wayTooManyReq {
 					go metrics.PushShieldMetrics("smart-shield")
 					utils.Log("SmartShield: WAYYYY Too many users on the server. Aborting right away.")
+					info.SetShield("overloaded")
 					http.Error(w, "Too many requests", http.StatusTooManyRequests)
 					return
 				}
@@ -416,6 +389,7 @@ func SmartShieldMiddleware(shieldID string, route utils.ProxyRouteConfig) func(h
 					if retries <= 0 {
 						go metrics.PushShieldMetrics("smart-shield")
 						utils.Log("SmartShield: Too many users on the server")
+						info.SetShield("overloaded")
 						http.Error(w, "Too many requests", http.StatusTooManyRequests)
 						return
 					}
@@ -424,7 +398,7 @@ func SmartShieldMiddleware(shieldID string, route utils.ProxyRouteConfig) func(h
 
 			userConsumed := shield.GetUserUsedBudgets(shieldID, clientID)
 
-			if !isPrivileged(r, policy) && !shield.isAllowedToReqest(shieldID, policy, userConsumed) {
+			if !isPrivileged(r, policy) && !isNeverBanned(r, policy) && !shield.isAllowedToReqest(shieldID, policy, userConsumed) {
 				lastBan := GetLastBan(clientID, true)
 				go metrics.PushShieldMetrics("smart-shield")
 				utils.IncrementIPAbuseCounter(clientID)
@@ -444,6 +418,7 @@ func SmartShieldMiddleware(shieldID string, route utils.ProxyRouteConfig) func(h
 				})
 
 				utils.Log("SmartShield: User is blocked due to abuse: " + fmt.Sprintf("%+v", lastBan))
+				info.SetShield("banned")
 				http.Error(w, "Too many requests", http.StatusTooManyRequests)
 				return
 			} else {
@@ -452,6 +427,10 @@ func SmartShieldMiddleware(shieldID string, route utils.ProxyRouteConfig) func(h
 					throttle = shield.computeThrottle(policy, userConsumed)
 				}
 
+				if throttle > 0 {
+					info.SetShield("throttled")
+				}
+
 				wrapper := &SmartResponseWriterWrapper {
 					ResponseWriter: w,
 					ThrottleNext:   throttle,
@@ -463,6 +442,7 @@ func SmartShieldMiddleware(shieldID string, route utils.ProxyRouteConfig) func(h
 					shieldID: shieldID,
 					policy: policy,
 					isPrivileged: isPrivileged(r, policy),
+					neverBanned: isNeverBanned(r, policy),
 				}
 
 				// add rate limite headers
@@ -510,7 +490,7 @@ func SmartShieldMiddleware(shieldID string, route utils.ProxyRouteConfig) func(h
 						"url": r.URL,
 					})
 
-					go metrics.PushRequestMetrics(route, wrapper.Status, wrapper.TimeStarted, wrapper.Bytes)
+					go metrics.PushRequestMetrics(route, info.Upstream(), wrapper.Status, wrapper.TimeStarted, wrapper.Bytes)
 					shield.Unlock()
 				})()
 
@@ -0,0 +1,428 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/aseracorp/resiOS/src/utils"
+)
+
+// The bans and the allowlist are kept in the embedded DB, so a restart does not lift them
+
+var BanTypeList = map[string]int{
+	"STRIKE": STRIKE,
+	"TEMP": TEMP,
+	"PERM": PERM,
+}
+
+type ShieldAllowlistEntry struct {
+	ClientID string `json:"clientID" bson:"_id"`
+	Note string `json:"note" bson:"Note"`
+	CreatedBy string `json:"createdBy" bson:"CreatedBy"`
+	CreatedAt time.Time `json:"createdAt" bson:"CreatedAt"`
+}
+
+var shieldAllowlist = map[string]ShieldAllowlistEntry{}
+var shieldAllowlistLock sync.RWMutex
+
+// addBan records a ban, the caller holds the lock of the state
+func (state *GlobalSmartShieldState) addBan(ban *UserBan) {
+	if ban.ID == "" {
+		ban.ID = primitive.NewObjectID().Hex()
+	}
+	if ban.Time.IsZero() {
+		ban.Time = time.Now()
+	}
+
+	state.bans = append(state.bans, ban)
+
+	go persistBan(*ban)
+}
+
+// StrikeClient gives a strike to a client caught outside of the shields, like by the login protection
+func StrikeClient(clientID string, route string, reason string) {
+	if isShieldAllowlisted(clientID, utils.SmartShieldPolicy{}) {
+		return
+	}
+
+	globalShieldState.Lock()
+	globalShieldState.addBan(&UserBan{
+		ClientID: clientID,
+		BanType: STRIKE,
+		Reason: reason,
+		Route: route,
+	})
+	globalShieldState.Unlock()
+
+	utils.Warn("SmartShield: " + clientID + " has received a strike: " + reason)
+}
+
+func persistBan(ban UserBan) {
+	c, closeDb, errCo := utils.GetEmbeddedCollection(utils.GetRootAppId(), "shield_bans")
+	defer closeDb()
+	if errCo != nil {
+		utils.Error("SmartShield: cannot save ban of " + ban.ClientID, errCo)
+		return
+	}
+
+	if _, err := c.InsertOne(nil, ban); err != nil {
+		utils.Error("SmartShield: cannot save ban of " + ban.ClientID, err)
+	}
+}
+
+// LoadShieldBans restores the bans and the allowlist saved before the last restart
+func LoadShieldBans() {
+	c, closeDb, errCo := utils.GetEmbeddedCollection(utils.GetRootAppId(), "shield_bans")
+	defer closeDb()
+	if errCo != nil {
+		utils.Error("SmartShield: cannot load bans", errCo)
+		return
+	}
+
+	bans := []*UserBan{}
+	cursor, err := c.Find(nil, map[string]interface{}{})
+	if err == nil {
+		err = cursor.All(nil, &bans)
+	}
+	if err != nil {
+		utils.Error("SmartShield: cannot load bans", err)
+		return
+	}
+
+	sort.SliceStable(bans, func(i, j int) bool {
+		return bans[i].Time.Before(bans[j].Time)
+	})
+
+	globalShieldState.Lock()
+	globalShieldState.bans = bans
+	globalShieldState.Unlock()
+
+	ca, closeDbA, errCo := utils.GetEmbeddedCollection(utils.GetRootAppId(), "shield_allowlist")
+	defer closeDbA()
+	if errCo != nil {
+		utils.Error("SmartShield: cannot load allowlist", errCo)
+		return
+	}
+
+	entries := []ShieldAllowlistEntry{}
+	cursor, err = ca.Find(nil, map[string]interface{}{})
+	if err == nil {
+		err = cursor.All(nil, &entries)
+	}
+	if err != nil {
+		utils.Error("SmartShield: cannot load allowlist", err)
+		return
+	}
+
+	shieldAllowlistLock.Lock()
+	shieldAllowlist = map[string]ShieldAllowlistEntry{}
+	for _, entry := range entries {
+		shieldAllowlist[entry.ClientID] = entry
+	}
+	shieldAllowlistLock.Unlock()
+
+	utils.Log("SmartShield: Loaded " + strconv.Itoa(len(bans)) + " bans and " + strconv.Itoa(len(entries)) + " allowlisted clients")
+}
+
+// deleteSavedBans removes from the DB the bans pruned by CleanUp
+func deleteSavedBans(ids []string) {
+	if len(ids) == 0 {
+		return
+	}
+
+	c, closeDb, errCo := utils.GetEmbeddedCollection(utils.GetRootAppId(), "shield_bans")
+	defer closeDb()
+	if errCo != nil {
+		utils.Error("SmartShield: cannot prune bans", errCo)
+		return
+	}
+
+	_, err := c.DeleteMany(nil, bson.M{
+		"_id": bson.M{"$in": ids},
+	})
+	if err != nil {
+		utils.Error("SmartShield: cannot prune bans", err)
+	}
+}
+
+// LiftBans removes every ban of a client and returns how many there were
+func LiftBans(clientID string) int {
+	globalShieldState.Lock()
+	bans := []*UserBan{}
+	for _, ban := range globalShieldState.bans {
+		if ban.ClientID != clientID {
+			bans = append(bans, ban)
+		}
+	}
+	lifted := len(globalShieldState.bans) - len(bans)
+	globalShieldState.bans = bans
+	globalShieldState.Unlock()
+
+	utils.ResetIPAbuseCounter(clientID)
+
+	c, closeDb, errCo := utils.GetEmbeddedCollection(utils.GetRootAppId(), "shield_bans")
+	defer closeDb()
+	if errCo != nil {
+		utils.Error("SmartShield: cannot lift bans of " + clientID, errCo)
+		return lifted
+	}
+
+	if _, err := c.DeleteMany(nil, map[string]interface{}{"ClientID": clientID}); err != nil {
+		utils.Error("SmartShield: cannot lift bans of " + clientID, err)
+	}
+
+	return lifted
+}
+
+type ShieldBanJSON struct {
+	UserBan
+	Active bool `json:"active"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// GetShieldBans lists the bans, latest first, search is matched against the client, route and reason
+func GetShieldBans(search string, banType string) []ShieldBanJSON {
+	globalShieldState.Lock()
+	defer globalShieldState.Unlock()
+
+	search = strings.ToLower(search)
+	result := []ShieldBanJSON{}
+
+	for i := len(globalShieldState.bans) - 1; i >= 0; i-- {
+		ban := globalShieldState.bans[i]
+
+		if typeValue, ok := BanTypeList[banType]; ok && ban.BanType != typeValue {
+			continue
+		}
+
+		if search != "" &&
+			!strings.Contains(strings.ToLower(ban.ClientID), search) &&
+			!strings.Contains(strings.ToLower(ban.Route), search) &&
+			!strings.Contains(strings.ToLower(ban.Reason), search) {
+			continue
+		}
+
+		banJSON := ShieldBanJSON{
+			UserBan: *ban,
+			Active: true,
+		}
+		if duration := globalShieldState.getBanEscalation(ban.Route).duration(ban.BanType); duration > 0 {
+			banJSON.ExpiresAt = ban.Time.Add(duration)
+			banJSON.Active = time.Now().Before(banJSON.ExpiresAt)
+		}
+
+		result = append(result, banJSON)
+	}
+
+	return result
+}
+
+type ShieldBanRequestJSON struct {
+	ClientID string `json:"clientID" validate:"required"`
+	// STRIKE, TEMP or PERM
+	Type string `json:"type"`
+	Reason string `json:"reason"`
+}
+
+type ShieldUnbanRequestJSON struct {
+	ClientID string `json:"clientID" validate:"required"`
+}
+
+func API_ShieldBans(w http.ResponseWriter, req *http.Request) {
+	if utils.AdminOnly(w, req) != nil {
+		return
+	}
+
+	if(req.Method == "GET") {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "OK",
+			"data": GetShieldBans(req.URL.Query().Get("search"), strings.ToUpper(req.URL.Query().Get("type"))),
+		})
+	} else if(req.Method == "POST") {
+		var request ShieldBanRequestJSON
+		err := json.NewDecoder(req.Body).Decode(&request)
+		if err != nil || net.ParseIP(request.ClientID) == nil {
+			utils.Error("ShieldBans: Invalid User Request", err)
+			utils.HTTPError(w, "Invalid request, clientID has to be an IP", http.StatusBadRequest, "HTTP001")
+			return
+		}
+
+		banType, ok := BanTypeList[strings.ToUpper(request.Type)]
+		if !ok {
+			banType = PERM
+		}
+
+		if isShieldAllowlisted(request.ClientID, utils.SmartShieldPolicy{}) {
+			utils.Error("ShieldBans: " + request.ClientID + " is allowlisted", nil)
+			utils.HTTPError(w, "This client is allowlisted", http.StatusConflict, "HTTP001")
+			return
+		}
+
+		reason := "Manual ban by " + req.Header.Get("x-cosmos-user")
+		if request.Reason != "" {
+			reason += ": " + request.Reason
+		}
+
+		ban := &UserBan{
+			ClientID: request.ClientID,
+			BanType: banType,
+			Reason: reason,
+			Route: "manual",
+		}
+
+		globalShieldState.Lock()
+		globalShieldState.addBan(ban)
+		globalShieldState.Unlock()
+
+		utils.Log("ShieldBans: " + reason + " of " + request.ClientID)
+
+		utils.TriggerEvent(
+			"cosmos.proxy.shield.ban",
+			"Manual ban of " + request.ClientID,
+			"warning",
+			"",
+			map[string]interface{}{
+			"clientID": request.ClientID,
+			"type": banType,
+			"reason": reason,
+		})
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "OK",
+			"data": ban,
+		})
+	} else if(req.Method == "DELETE") {
+		var request ShieldUnbanRequestJSON
+		err := json.NewDecoder(req.Body).Decode(&request)
+		if err != nil || request.ClientID == "" {
+			utils.Error("ShieldBans: Invalid User Request", err)
+			utils.HTTPError(w, "Invalid request", http.StatusBadRequest, "HTTP001")
+			return
+		}
+
+		lifted := LiftBans(request.ClientID)
+
+		utils.Log("ShieldBans: " + req.Header.Get("x-cosmos-user") + " lifted " + strconv.Itoa(lifted) + " bans of " + request.ClientID)
+
+		utils.TriggerEvent(
+			"cosmos.proxy.shield.unban",
+			"Bans of " + request.ClientID + " lifted",
+			"info",
+			"",
+			map[string]interface{}{
+			"clientID": request.ClientID,
+			"lifted": lifted,
+		})
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "OK",
+			"data": lifted,
+		})
+	} else {
+		utils.Error("ShieldBans: Method not allowed" + req.Method, nil)
+		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
+		return
+	}
+}
+
+type ShieldAllowlistRequestJSON struct {
+	ClientID string `json:"clientID" validate:"required"`
+	Note string `json:"note"`
+}
+
+func API_ShieldAllowlist(w http.ResponseWriter, req *http.Request) {
+	if utils.AdminOnly(w, req) != nil {
+		return
+	}
+
+	if(req.Method == "GET") {
+		shieldAllowlistLock.RLock()
+		entries := []ShieldAllowlistEntry{}
+		for _, entry := range shieldAllowlist {
+			entries = append(entries, entry)
+		}
+		shieldAllowlistLock.RUnlock()
+
+		sort.Slice(entries, func(i, j int) bool {
+			return entries[i].ClientID < entries[j].ClientID
+		})
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "OK",
+			"data": entries,
+		})
+		return
+	}
+
+	if req.Method != "POST" && req.Method != "DELETE" {
+		utils.Error("ShieldAllowlist: Method not allowed" + req.Method, nil)
+		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
+		return
+	}
+
+	var request ShieldAllowlistRequestJSON
+	err := json.NewDecoder(req.Body).Decode(&request)
+	if err != nil || net.ParseIP(request.ClientID) == nil {
+		utils.Error("ShieldAllowlist: Invalid User Request", err)
+		utils.HTTPError(w, "Invalid request, clientID has to be an IP", http.StatusBadRequest, "HTTP001")
+		return
+	}
+
+	c, closeDb, errCo := utils.GetEmbeddedCollection(utils.GetRootAppId(), "shield_allowlist")
+	defer closeDb()
+	if errCo != nil {
+		utils.Error("Database Connect", errCo)
+		utils.HTTPError(w, "Database Error", http.StatusInternalServerError, "DB001")
+		return
+	}
+
+	if req.Method == "POST" {
+		entry := ShieldAllowlistEntry{
+			ClientID: request.ClientID,
+			Note: request.Note,
+			CreatedBy: req.Header.Get("x-cosmos-user"),
+			CreatedAt: time.Now(),
+		}
+
+		c.DeleteOne(nil, map[string]interface{}{"_id": entry.ClientID})
+		if _, err := c.InsertOne(nil, entry); err != nil {
+			utils.Error("ShieldAllowlist: cannot save " + entry.ClientID, err)
+			utils.HTTPError(w, "Database Error", http.StatusInternalServerError, "DB001")
+			return
+		}
+
+		shieldAllowlistLock.Lock()
+		shieldAllowlist[entry.ClientID] = entry
+		shieldAllowlistLock.Unlock()
+
+		// nothing left to block it
+		LiftBans(entry.ClientID)
+
+		utils.Log("ShieldAllowlist: " + entry.CreatedBy + " allowlisted " + entry.ClientID)
+	} else {
+		if _, err := c.DeleteOne(nil, map[string]interface{}{"_id": request.ClientID}); err != nil {
+			utils.Error("ShieldAllowlist: cannot remove " + request.ClientID, err)
+			utils.HTTPError(w, "Database Error", http.StatusInternalServerError, "DB001")
+			return
+		}
+
+		shieldAllowlistLock.Lock()
+		delete(shieldAllowlist, request.ClientID)
+		shieldAllowlistLock.Unlock()
+
+		utils.Log("ShieldAllowlist: " + req.Header.Get("x-cosmos-user") + " removed " + request.ClientID)
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": "OK",
+	})
+}
@@ -0,0 +1,223 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aseracorp/resiOS/src/utils"
+)
+
+// the usual gateways, when no global allowlist is set
+var defaultShieldAllowlist = []string{"192.168.1.1", "192.168.0.1", "192.168.0.254", "172.17.0.1"}
+
+type shieldEscalation struct {
+	strikeDuration time.Duration
+	strikesBeforeTempBan int
+	strikeWindow time.Duration
+	tempBanDuration time.Duration
+	tempBansBeforePermBan int
+	tempBanWindow time.Duration
+}
+
+func escalationValue(route int, global int, def int) int {
+	if route != 0 {
+		return route
+	}
+	if global != 0 {
+		return global
+	}
+	return def
+}
+
+// getShieldEscalation merges the escalation of the route with the global one
+func getShieldEscalation(policy utils.SmartShieldPolicy) shieldEscalation {
+	route := policy.Escalation
+	global := utils.GetMainConfig().HTTPConfig.SmartShield.Escalation
+
+	return shieldEscalation{
+		strikeDuration: time.Duration(escalationValue(route.StrikeDuration, global.StrikeDuration, 60)) * time.Minute,
+		strikesBeforeTempBan: escalationValue(route.StrikesBeforeTempBan, global.StrikesBeforeTempBan, 3),
+		strikeWindow: time.Duration(escalationValue(route.StrikeWindow, global.StrikeWindow, 24)) * time.Hour,
+		tempBanDuration: time.Duration(escalationValue(route.TempBanDuration, global.TempBanDuration, 4 * 60)) * time.Minute,
+		tempBansBeforePermBan: escalationValue(route.TempBansBeforePermBan, global.TempBansBeforePermBan, 3),
+		tempBanWindow: time.Duration(escalationValue(route.TempBanWindow, global.TempBanWindow, 72)) * time.Hour,
+	}
+}
+
+// getBanEscalation is the escalation of the shield which issued a ban, as given by its route.
+// The manual bans and the ones of shields not built since the start use the global one. The caller holds the lock of the state
+func (state *GlobalSmartShieldState) getBanEscalation(shieldID string) shieldEscalation {
+	if escalation, ok := state.escalations[shieldID]; ok {
+		return escalation
+	}
+	return getShieldEscalation(utils.SmartShieldPolicy{})
+}
+
+// setBanEscalation remembers the escalation of a shield for the expiry of its bans, the caller holds the lock of the state
+func (state *GlobalSmartShieldState) setBanEscalation(shieldID string, escalation shieldEscalation) {
+	if state.escalations == nil {
+		state.escalations = map[string]shieldEscalation{}
+	}
+	state.escalations[shieldID] = escalation
+}
+
+// registerBanEscalation is called by the HTTP, TCP and UDP shields when they are built, so the bans
+// loaded from the database expire with the escalation of their route, discovered and socket routes included
+func registerBanEscalation(shieldID string, policy utils.SmartShieldPolicy) {
+	globalShieldState.Lock()
+	defer globalShieldState.Unlock()
+
+	globalShieldState.setBanEscalation(shieldID, getShieldEscalation(policy))
+}
+
+// duration is how long a ban blocks the client, forever if 0
+func (escalation shieldEscalation) duration(banType int) time.Duration {
+	switch banType {
+	case STRIKE:
+		return escalation.strikeDuration
+	case TEMP:
+		return escalation.tempBanDuration
+	}
+	return 0
+}
+
+// retention is how long a ban still counts towards the next step of the ladder
+func (escalation shieldEscalation) retention(banType int) time.Duration {
+	switch banType {
+	case STRIKE:
+		if escalation.strikeWindow > escalation.strikeDuration {
+			return escalation.strikeWindow
+		}
+		return escalation.strikeDuration
+	case TEMP:
+		if escalation.tempBanWindow > escalation.tempBanDuration {
+			return escalation.tempBanWindow
+		}
+		return escalation.tempBanDuration
+	}
+	return 0
+}
+
+// escalateBans tells if the client is blocked by one of its bans, and climbs the ladder when it has too many.
+// newBan is the ban added, if any. The caller holds the lock of the state
+func (state *GlobalSmartShieldState) escalateBans(clientID string, routeName string, escalation shieldEscalation) (blocked bool, newBan *UserBan) {
+	state.setBanEscalation(routeName, escalation)
+
+	nbTempBans := 0
+	nbStrikes := 0
+
+	now := time.Now()
+
+	for i := len(state.bans) - 1; i >= 0; i-- {
+		ban := state.bans[i]
+		if ban.ClientID != clientID {
+			continue
+		}
+
+		switch ban.BanType {
+		case PERM:
+			return true, nil
+		case TEMP:
+			if ban.Time.Add(escalation.tempBanDuration).After(now) {
+				return true, nil
+			} else if ban.Time.Add(escalation.tempBanWindow).After(now) {
+				nbTempBans++
+			}
+		case STRIKE:
+			if ban.Time.Add(escalation.strikeDuration).After(now) {
+				return true, nil
+			} else if ban.Time.Add(escalation.strikeWindow).After(now) {
+				nbStrikes++
+			}
+		}
+	}
+
+	if escalation.tempBansBeforePermBan > 0 && nbTempBans >= escalation.tempBansBeforePermBan {
+		newBan = &UserBan{
+			ClientID: clientID,
+			BanType: PERM,
+			Reason: strconv.Itoa(nbTempBans) + " temporary bans in " + escalation.tempBanWindow.String(),
+			Route: routeName,
+		}
+	} else if escalation.strikesBeforeTempBan > 0 && nbStrikes >= escalation.strikesBeforeTempBan {
+		newBan = &UserBan{
+			ClientID: clientID,
+			BanType: TEMP,
+			Reason: strconv.Itoa(nbStrikes) + " strikes in " + escalation.strikeWindow.String(),
+			Route: routeName,
+		}
+	}
+
+	if newBan != nil {
+		state.addBan(newBan)
+		return true, newBan
+	}
+
+	return false, nil
+}
+
+var shieldAllowlistNets = map[string][]*net.IPNet{}
+var shieldAllowlistNetsLock sync.Mutex
+
+// parseShieldAllowlist keeps the parsed lists, they are checked on every request
+func parseShieldAllowlist(list []string) []*net.IPNet {
+	key := strings.Join(list, ",")
+
+	shieldAllowlistNetsLock.Lock()
+	defer shieldAllowlistNetsLock.Unlock()
+
+	nets, ok := shieldAllowlistNets[key]
+	if !ok {
+		if len(shieldAllowlistNets) > 100 {
+			shieldAllowlistNets = map[string][]*net.IPNet{}
+		}
+		nets = utils.ParseCIDRList(list)
+		shieldAllowlistNets[key] = nets
+	}
+
+	return nets
+}
+
+// isShieldAllowlisted clients are never banned: the global and route allowlists, and the ones added from the API
+func isShieldAllowlisted(clientID string, policy utils.SmartShieldPolicy) bool {
+	shieldAllowlistLock.RLock()
+	_, ok := shieldAllowlist[clientID]
+	shieldAllowlistLock.RUnlock()
+	if ok {
+		return true
+	}
+
+	ip := net.ParseIP(clientID)
+	if ip == nil {
+		return false
+	}
+
+	global := utils.GetMainConfig().HTTPConfig.SmartShield.Allowlist
+	if global == nil {
+		global = defaultShieldAllowlist
+	}
+
+	for _, list := range [][]string{global, policy.Allowlist} {
+		for _, ipNet := range parseShieldAllowlist(list) {
+			if ipNet.Contains(ip) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// isNeverBanned logged in admins, when the route or the global policy says so
+func isNeverBanned(req *http.Request, policy utils.SmartShieldPolicy) bool {
+	if !policy.NeverBanAdmins && !utils.GetMainConfig().HTTPConfig.SmartShield.NeverBanAdmins {
+		return false
+	}
+
+	role, _ := strconv.Atoi(req.Header.Get("x-cosmos-role"))
+	return role >= utils.ADMIN
+}
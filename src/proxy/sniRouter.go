@@ -0,0 +1,349 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aseracorp/resiOS/src/docker"
+	"github.com/aseracorp/resiOS/src/utils"
+)
+
+// Routes with TLSPassthrough share the HTTPS port: the SNI of the ClientHello is read without
+// terminating TLS, matching connections are piped as-is to the target, the others go to the HTTPS server
+
+var errClientHelloRead = errors.New("client hello read")
+
+// readOnlyConn lets crypto/tls parse a ClientHello without ever answering it
+type readOnlyConn struct {
+	reader io.Reader
+}
+
+func (c readOnlyConn) Read(p []byte) (int, error)         { return c.reader.Read(p) }
+func (c readOnlyConn) Write(p []byte) (int, error)        { return 0, io.ErrClosedPipe }
+func (c readOnlyConn) Close() error                       { return nil }
+func (c readOnlyConn) LocalAddr() net.Addr                { return nil }
+func (c readOnlyConn) RemoteAddr() net.Addr               { return nil }
+func (c readOnlyConn) SetDeadline(t time.Time) error      { return nil }
+func (c readOnlyConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c readOnlyConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// peekedConn replays the bytes consumed while looking for the SNI
+type peekedConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c *peekedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// peekServerName returns the SNI of the connection and a conn that still starts with the ClientHello
+func peekServerName(conn net.Conn) (string, net.Conn) {
+	var peeked bytes.Buffer
+	serverName := ""
+
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	tls.Server(readOnlyConn{reader: io.TeeReader(conn, &peeked)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = hello.ServerName
+			return nil, errClientHelloRead
+		},
+	}).Handshake()
+	conn.SetReadDeadline(time.Time{})
+
+	return strings.ToLower(serverName), &peekedConn{
+		Conn: conn,
+		reader: io.MultiReader(bytes.NewReader(peeked.Bytes()), conn),
+	}
+}
+
+type sniRoute struct {
+	hosts []string
+	// hosts covered by a wildcard of the route but served by Cosmos
+	excluded []string
+	target string
+	route utils.ProxyRouteConfig
+}
+
+// matchesSNIHost compares a server name, or another pattern, to a host pattern.
+// *.example.com matches the subdomains at any depth but not example.com itself, the apex has to be listed too
+func matchesSNIHost(pattern string, serverName string) bool {
+	if pattern == serverName {
+		return true
+	}
+	return strings.HasPrefix(pattern, "*.") && strings.HasSuffix(serverName, pattern[1:])
+}
+
+func (r sniRoute) matches(serverName string) bool {
+	for _, host := range r.excluded {
+		if matchesSNIHost(host, serverName) {
+			return false
+		}
+	}
+	for _, host := range r.hosts {
+		if matchesSNIHost(host, serverName) {
+			return true
+		}
+	}
+	return false
+}
+
+// getPassthroughTarget accepts host:port, tcp://host:port or https://host[:port]
+func getPassthroughTarget(route utils.ProxyRouteConfig) (string, error) {
+	target := route.Target
+	if !strings.Contains(target, "://") {
+		target = "tcp://" + target
+	}
+
+	targetURL, err := url.Parse(target)
+	if err != nil {
+		return "", err
+	}
+
+	port := targetURL.Port()
+	if port == "" {
+		if targetURL.Scheme != "https" {
+			return "", errors.New("target " + route.Target + " has no port")
+		}
+		port = "443"
+	}
+
+	host := targetURL.Hostname()
+	if route.Mode == "SERVAPP" && (!utils.IsInsideContainer || utils.IsHostNetwork) {
+		targetIP, err := docker.GetContainerIPByName(host)
+		if err != nil {
+			return "", err
+		}
+		host = targetIP
+	}
+
+	return net.JoinHostPort(host, port), nil
+}
+
+// getPassthroughHosts is the list of hosts of the route, lowercase and without port
+func getPassthroughHosts(route utils.ProxyRouteConfig) []string {
+	hosts := []string{}
+	for _, host := range strings.Split(route.Host, ",") {
+		host = strings.ToLower(strings.TrimSpace(host))
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if host != "" {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
+
+func getPassthroughRoutes() []sniRoute {
+	config := utils.GetMainConfig()
+	routesList := append([]utils.ProxyRouteConfig{}, config.HTTPConfig.ProxyConfig.Routes...)
+	routesList = append(routesList, utils.GetDiscoveredRoutes()...)
+
+	// the hosts Cosmos terminates itself can never be passed through
+	reserved := map[string]string{}
+	for _, hostname := range getPassthroughHosts(utils.ProxyRouteConfig{Host: config.HTTPConfig.Hostname}) {
+		reserved[hostname] = "the Cosmos hostname"
+	}
+	for _, route := range routesList {
+		if route.TLSPassthrough || route.Disabled || !route.UseHost {
+			continue
+		}
+		for _, host := range getPassthroughHosts(route) {
+			if _, ok := reserved[host]; !ok {
+				reserved[host] = "route " + route.Name
+			}
+		}
+	}
+
+	routes := []sniRoute{}
+	for _, route := range routesList {
+		if !route.TLSPassthrough || route.Disabled {
+			continue
+		}
+
+		if !route.UseHost || route.Host == "" {
+			utils.Error("[SNI] Passthrough route " + route.Name + " needs a host to match", nil)
+			continue
+		}
+
+		target, err := getPassthroughTarget(route)
+		if err != nil {
+			utils.Error("[SNI] Passthrough route " + route.Name, err)
+			continue
+		}
+
+		hosts := []string{}
+		excluded := []string{}
+	hostsLoop:
+		for _, host := range getPassthroughHosts(route) {
+			for reservedHost, owner := range reserved {
+				if matchesSNIHost(reservedHost, host) {
+					utils.Error("[SNI] Passthrough route " + route.Name + " cannot use " + host + ", it is already served by " + owner, nil)
+					continue hostsLoop
+				}
+			}
+			for reservedHost, owner := range reserved {
+				if matchesSNIHost(host, reservedHost) {
+					utils.Warn("[SNI] Passthrough route " + route.Name + " does not get " + reservedHost + " from " + host + ", it is served by " + owner)
+					excluded = append(excluded, reservedHost)
+				}
+			}
+			hosts = append(hosts, host)
+		}
+		if len(hosts) == 0 {
+			continue
+		}
+
+		routes = append(routes, sniRoute{
+			hosts: hosts,
+			excluded: excluded,
+			target: target,
+			route: route,
+		})
+	}
+
+	return routes
+}
+
+// SNIListener wraps the HTTPS listener, Accept only returns the connections Cosmos has to terminate
+type SNIListener struct {
+	net.Listener
+	routes []sniRoute
+	conns chan net.Conn
+	closed chan struct{}
+	closeOnce sync.Once
+	err error
+}
+
+// NewSNIListener returns the listener untouched if no route uses TLS passthrough
+func NewSNIListener(listener net.Listener) net.Listener {
+	routes := getPassthroughRoutes()
+	if len(routes) == 0 {
+		return listener
+	}
+
+	utils.Log("[SNI] TLS passthrough enabled for " + strings.Join(func() []string {
+		names := []string{}
+		for _, route := range routes {
+			names = append(names, route.route.Name)
+		}
+		return names
+	}(), ", "))
+
+	l := &SNIListener{
+		Listener: listener,
+		routes: routes,
+		conns: make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+
+	go l.acceptLoop()
+
+	return l
+}
+
+func (l *SNIListener) acceptLoop() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				time.Sleep(50 * time.Millisecond)
+				continue
+			}
+
+			l.err = err
+			l.Close()
+			return
+		}
+
+		go l.route(conn)
+	}
+}
+
+func (l *SNIListener) route(conn net.Conn) {
+	serverName, conn := peekServerName(conn)
+
+	for _, route := range l.routes {
+		if serverName != "" && route.matches(serverName) {
+			l.passthrough(conn, route)
+			return
+		}
+	}
+
+	select {
+	case l.conns <- conn:
+	case <-l.closed:
+		conn.Close()
+	}
+}
+
+func (l *SNIListener) passthrough(client net.Conn, route sniRoute) {
+	shieldedClient := TCPSmartShieldMiddleware("sni-" + route.route.Name, route.route)(client)
+	if shieldedClient == nil {
+		client.Close()
+		return
+	}
+
+	utils.Debug("[SNI] Passing TLS connection through to " + route.target + " for route " + route.route.Name)
+
+	server, err := net.DialTimeout("tcp", route.target, 10 * time.Second)
+	if err != nil {
+		utils.Error("[SNI] Failed to connect to " + route.target, err)
+		shieldedClient.Close()
+		return
+	}
+
+	if route.route.SendProxyProtocol != "" {
+		err = WriteProxyProtocolHeader(server, route.route.SendProxyProtocol, shieldedClient.RemoteAddr(), shieldedClient.LocalAddr())
+		if err != nil {
+			utils.Error("[SNI] Failed to send PROXY protocol header to " + route.target, err)
+			shieldedClient.Close()
+			server.Close()
+			return
+		}
+	}
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(server, shieldedClient)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(shieldedClient, server)
+		done <- struct{}{}
+	}()
+
+	<-done
+	shieldedClient.Close()
+	server.Close()
+}
+
+func (l *SNIListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		if l.err != nil {
+			return nil, l.err
+		}
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *SNIListener) Close() error {
+	err := net.ErrClosed
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		err = l.Listener.Close()
+	})
+	return err
+}
@@ -0,0 +1,204 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http2"
+
+	"github.com/aseracorp/resiOS/src/docker"
+	"github.com/aseracorp/resiOS/src/utils"
+)
+
+// normalizeTarget converts the legacy http://unix:///path.sock notation to unix:///path.sock
+func normalizeTarget(target string) string {
+	if strings.HasPrefix(target, "http://unix://") {
+		return "unix://" + strings.TrimPrefix(target, "http://unix://")
+	}
+	return target
+}
+
+func getUpstreamProtocol(route utils.ProxyRouteConfig) string {
+	if protocol, ok := utils.UpstreamProtocolList[strings.ToUpper(route.UpstreamProtocol)]; ok {
+		return protocol
+	}
+	return "HTTP"
+}
+
+// getUnixSocketPath resolves unix:///path.sock on the host, or unix://container/path.sock inside the volumes of a container
+func getUnixSocketPath(targetURL *url.URL) (string, error) {
+	socketPath := targetURL.Path
+
+	if targetURL.Host != "" {
+		hostPath, err := docker.GetContainerHostPath(targetURL.Host, targetURL.Path)
+		if err != nil {
+			return "", err
+		}
+		socketPath = hostPath
+	}
+
+	// host paths are only reachable through /mnt/host when Cosmos runs in a container
+	if utils.IsInsideContainer {
+		if _, err := os.Stat(socketPath); err != nil {
+			if _, err := os.Stat("/mnt/host" + socketPath); err == nil {
+				socketPath = "/mnt/host" + socketPath
+			}
+		}
+	}
+
+	return socketPath, nil
+}
+
+// ValidateRouteTargets checks the targets are usable with the mode and upstream protocol of the route
+func ValidateRouteTargets(route utils.ProxyRouteConfig) error {
+	if route.UpstreamProtocol != "" {
+		if _, ok := utils.UpstreamProtocolList[strings.ToUpper(route.UpstreamProtocol)]; !ok {
+			return errors.New("unknown upstream protocol " + route.UpstreamProtocol)
+		}
+	}
+
+	if route.Mode != "SERVAPP" && route.Mode != "PROXY" && route.Mode != "REDIRECT" {
+		return nil
+	}
+
+	for _, target := range GetRouteTargets(route) {
+		targetURL, err := url.Parse(target.Target)
+		if err != nil {
+			return errors.New("invalid target URL " + target.Target + ": " + err.Error())
+		}
+
+		if route.Mode == "REDIRECT" && targetURL.Scheme == "" {
+			// relative redirect
+			continue
+		}
+
+		switch targetURL.Scheme {
+		case "http", "https":
+			if targetURL.Host == "" {
+				return errors.New("target " + target.Target + " has no host")
+			}
+		case "unix":
+			if route.Mode == "REDIRECT" {
+				return errors.New("cannot redirect to a unix socket " + target.Target)
+			}
+			if targetURL.Path == "" || targetURL.Path == "/" {
+				return errors.New("target " + target.Target + " has no socket path")
+			}
+		default:
+			return errors.New("unsupported scheme " + targetURL.Scheme + " in target " + target.Target + ", use http, https or unix")
+		}
+	}
+
+	return nil
+}
+
+// newUpstreamTransport returns the transport to reach a target, and the URL the director has to use
+func newUpstreamTransport(targetURL *url.URL, acceptInsecureHTTPSTarget bool, route utils.ProxyRouteConfig) (http.RoundTripper, *url.URL, error) {
+	dialer := &net.Dialer{
+		Timeout: 30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	customDial := false
+
+	if utils.GetMainConfig().ConstellationConfig.Enabled && utils.GetMainConfig().ConstellationConfig.SlaveMode {
+		dialer = &net.Dialer{
+			Timeout:   5 * time.Second,
+			KeepAlive: 5 * time.Second,
+			Resolver: &net.Resolver{
+				PreferGo: true,
+				Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+					return net.Dial(network, "192.168.201.1:53")
+				},
+			},
+		}
+		customDial = true
+	}
+
+	dial := dialer.DialContext
+	directorURL := targetURL
+
+	if targetURL.Scheme == "unix" {
+		socketURL := *targetURL
+		dial = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			socketPath, err := getUnixSocketPath(&socketURL)
+			if err != nil {
+				return nil, err
+			}
+			return dialer.DialContext(ctx, "unix", socketPath)
+		}
+		customDial = true
+
+		// the socket path is not part of the request, the Host header is kept from the client
+		directorURL = &url.URL{
+			Scheme: "http",
+			Host: "localhost",
+		}
+	}
+
+	var tlsConfig *tls.Config
+	if acceptInsecureHTTPSTarget {
+		tlsConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+
+	protocol := getUpstreamProtocol(route)
+
+	if protocol == "H2C" || (protocol == "GRPC" && directorURL.Scheme == "http") {
+		return &http2.Transport{
+			AllowHTTP: true,
+			// h2c: plain connection, no TLS handshake
+			DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				return dial(ctx, network, addr)
+			},
+		}, directorURL, nil
+	}
+
+	if protocol == "GRPC" {
+		return &http2.Transport{
+			TLSClientConfig: tlsConfig,
+			DialTLSContext: func(ctx context.Context, network, addr string, config *tls.Config) (net.Conn, error) {
+				conn, err := dial(ctx, network, addr)
+				if err != nil {
+					return nil, err
+				}
+				tlsConn := tls.Client(conn, config)
+				if err := tlsConn.HandshakeContext(ctx); err != nil {
+					conn.Close()
+					return nil, err
+				}
+				return tlsConn, nil
+			},
+		}, directorURL, nil
+	}
+
+	customTransport := &http.Transport{}
+	if customDial {
+		customTransport.DialContext = dial
+	}
+	if tlsConfig != nil {
+		customTransport.TLSClientConfig = tlsConfig
+	}
+
+	return customTransport, directorURL, nil
+}
+
+func isGRPCRequest(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc")
+}
+
+// writeGRPCError answers in a way gRPC clients understand, the status is in the trailers-only response
+func writeGRPCError(w http.ResponseWriter, code int, message string) {
+	header := w.Header()
+	header.Del("Content-Length")
+	header.Set("Content-Type", "application/grpc")
+	header.Set("Grpc-Status", strconv.Itoa(code))
+	header.Set("Grpc-Message", url.PathEscape(message))
+	w.WriteHeader(http.StatusOK)
+}
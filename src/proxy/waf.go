@@ -0,0 +1,319 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/aseracorp/resiOS/src/metrics"
+	"github.com/aseracorp/resiOS/src/utils"
+)
+
+// only the beginning of the bodies is inspected, the rest is streamed untouched
+const wafMaxInspectedBody = 64 * 1024
+
+// the built-in rule sets, enabled unless listed in DisabledRuleSets
+var wafRuleSets = map[string][]utils.ProxyWAFRule{
+	"PATH_TRAVERSAL": {
+		{Name: "path-traversal", Target: "URI", Pattern: `(\.\.[/\\]|[/\\]\.\.$|%2e%2e(%2f|%5c|/|\\)|\.\.(%2f|%5c)|%252e%252e|%c0%ae)`},
+		{Name: "null-byte", Target: "URI", Pattern: `%00`},
+		{Name: "sensitive-files", Target: "PATH", Pattern: `(/etc/(passwd|shadow|hosts)$|/proc/self/|(^|/)\.(git|svn|hg)/|(^|/)\.env$|(^|/)\.ht(access|passwd)$)`},
+	},
+	"SQLI": {
+		{Name: "sqli-union", Target: "QUERY", Pattern: `\bunion\b[\s/*+()]+(all[\s/*+()]+)?select\b`},
+		{Name: "sqli-tautology", Target: "QUERY", Pattern: `['"]\s*(or|and)\s+['"]?\w+['"]?\s*=\s*['"]?\w+`},
+		{Name: "sqli-stacked", Target: "QUERY", Pattern: `;\s*(drop|truncate|shutdown|alter)\s+(table|database)?\b`},
+		{Name: "sqli-functions", Target: "QUERY", Pattern: `(\b(sleep|benchmark|pg_sleep|load_file)\s*\(|\bwaitfor\s+delay\b|\binformation_schema\b|\bxp_cmdshell\b)`},
+	},
+	"XSS": {
+		{Name: "xss-script", Target: "QUERY", Pattern: `(<\s*script\b|<\s*/\s*script\s*>)`},
+		{Name: "xss-javascript-uri", Target: "QUERY", Pattern: `(javascript|vbscript)\s*:`},
+		{Name: "xss-event-handler", Target: "QUERY", Pattern: `<[^>]*\bon(error|load|mouseover|focus|click|toggle|animationstart|pointerover)\s*=`},
+		{Name: "xss-tags", Target: "QUERY", Pattern: `<\s*(iframe|object|embed|svg|math|base)\b`},
+		{Name: "xss-dom", Target: "QUERY", Pattern: `\bdocument\.(cookie|domain|write)\b`},
+	},
+	"BAD_USER_AGENTS": {
+		{Name: "scanner-user-agent", Target: "USER_AGENT", Pattern: `(sqlmap|nikto|nmap|masscan|zgrab|nuclei|acunetix|netsparker|wpscan|dirbuster|gobuster|havij|w3af|openvas|fimap|jorgee|zmeu)`},
+	},
+}
+
+// the content rule sets also look at the body when it is inspected
+var wafBodyRuleSets = map[string]bool{
+	"SQLI": true,
+	"XSS": true,
+}
+
+type wafRule struct {
+	name string
+	target string
+	header string
+	pattern *regexp.Regexp
+	block bool
+}
+
+func getWAFMode(mode string, def string) string {
+	if mode, ok := utils.WAFModeList[strings.ToUpper(mode)]; ok {
+		return mode
+	}
+	return def
+}
+
+func compileWAFRule(config utils.ProxyWAFRule, defaultMode string) (wafRule, bool) {
+	target, ok := utils.WAFRuleTargetList[strings.ToUpper(config.Target)]
+	if !ok {
+		utils.Error("WAF: Unknown target " + config.Target + " for rule " + config.Name + ", ignoring it", nil)
+		return wafRule{}, false
+	}
+
+	pattern, err := regexp.Compile("(?i)" + config.Pattern)
+	if err != nil || config.Pattern == "" {
+		utils.Error("WAF: Invalid pattern for rule " + config.Name + ", ignoring it", err)
+		return wafRule{}, false
+	}
+
+	name := utils.SanitizeName(config.Name)
+	if name == "" {
+		name = "custom"
+	}
+
+	return wafRule{
+		name: name,
+		target: target,
+		header: config.Header,
+		pattern: pattern,
+		block: getWAFMode(config.Mode, defaultMode) == "BLOCK",
+	}, true
+}
+
+// compileWAFRules returns the enabled built-in rules followed by the ones of the route
+func compileWAFRules(config utils.ProxyWAFConfig, mode string) []wafRule {
+	disabled := map[string]bool{}
+	for _, set := range config.DisabledRuleSets {
+		disabled[strings.ToUpper(set)] = true
+	}
+
+	rules := []wafRule{}
+
+	for _, set := range []string{"PATH_TRAVERSAL", "SQLI", "XSS", "BAD_USER_AGENTS"} {
+		if disabled[set] {
+			continue
+		}
+		for _, ruleConfig := range wafRuleSets[set] {
+			if rule, ok := compileWAFRule(ruleConfig, mode); ok {
+				rules = append(rules, rule)
+				if config.InspectBody && wafBodyRuleSets[set] {
+					rule.target = "BODY"
+					rules = append(rules, rule)
+				}
+			}
+		}
+	}
+
+	for _, ruleConfig := range config.Rules {
+		if ruleConfig.Disabled {
+			continue
+		}
+		if rule, ok := compileWAFRule(ruleConfig, mode); ok {
+			rules = append(rules, rule)
+		}
+	}
+
+	return rules
+}
+
+// wafBodyCounter reports a body over the limit once it is read, for the bodies without a length
+type wafBodyCounter struct {
+	io.ReadCloser
+	read int64
+	limit int64
+	onLimit func()
+}
+
+func (c *wafBodyCounter) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.read += int64(n)
+	if c.onLimit != nil && c.read > c.limit {
+		c.onLimit()
+		c.onLimit = nil
+	}
+	return n, err
+}
+
+func getHeadersSize(r *http.Request) int {
+	size := 0
+	for name, values := range r.Header {
+		for _, value := range values {
+			size += len(name) + len(value)
+		}
+	}
+	return size
+}
+
+func wafTargetValue(r *http.Request, rule wafRule, body []byte) string {
+	switch rule.target {
+	case "PATH":
+		return r.URL.Path
+	case "QUERY":
+		query, err := url.QueryUnescape(r.URL.RawQuery)
+		if err != nil {
+			return r.URL.RawQuery
+		}
+		return query
+	case "URI":
+		if r.RequestURI != "" {
+			return r.RequestURI
+		}
+		return r.URL.RequestURI()
+	case "HEADER":
+		if rule.header != "" {
+			return strings.Join(r.Header.Values(rule.header), "\n")
+		}
+		headers := []string{}
+		for name, values := range r.Header {
+			headers = append(headers, name + ": " + strings.Join(values, ", "))
+		}
+		return strings.Join(headers, "\n")
+	case "USER_AGENT":
+		return r.UserAgent()
+	case "METHOD":
+		return r.Method
+	case "BODY":
+		if body == nil {
+			return ""
+		}
+		if decoded, err := url.QueryUnescape(string(body)); err == nil {
+			return decoded
+		}
+		return string(body)
+	}
+	return ""
+}
+
+func pushWAFMetrics(route utils.ProxyRouteConfig, rule string) {
+	if utils.GetMainConfig().MonitoringDisabled {
+		return
+	}
+
+	metrics.PushSetMetric("proxy.waf." + rule + "." + route.Name, 1, metrics.DataDef{
+		Max: 0,
+		Period: time.Second * 30,
+		Label: "WAF " + rule + " " + route.Name,
+		AggloType: "sum",
+		SetOperation: "sum",
+		Object: "route@" + route.Name,
+	})
+}
+
+// wafHit records a rule matching a request, the abuse counter of the client only grows when it is blocked
+func wafHit(r *http.Request, route utils.ProxyRouteConfig, clientID string, rule string, blocked bool) {
+	mode := "DETECT"
+	if blocked {
+		mode = "BLOCK"
+	}
+
+	utils.Warn("WAF: Rule " + rule + " hit on route " + route.Name + " by " + clientID + " (" + mode + "): " + r.Method + " " + r.URL.Path)
+
+	go pushWAFMetrics(route, rule)
+
+	if blocked {
+		go metrics.PushShieldMetrics("waf")
+		utils.IncrementIPAbuseCounter(clientID)
+
+		if info := getRouteRequestInfo(r); info != nil {
+			info.SetShield("waf")
+		}
+	}
+
+	utils.TriggerEvent(
+		"cosmos.proxy.waf." + route.Name,
+		"WAF rule " + rule + " hit on " + route.Name + " by " + clientID,
+		"warning",
+		"route@" + route.Name,
+		map[string]interface{}{
+		"route": route.Name,
+		"rule": rule,
+		"mode": mode,
+		"clientID": clientID,
+		"method": r.Method,
+		"hostname": r.Host,
+		"url": r.URL.String(),
+	})
+}
+
+// WAFMiddleware checks the requests against the rules of the route, in DETECT mode the hits are only reported
+func WAFMiddleware(route utils.ProxyRouteConfig) func(next http.Handler) http.Handler {
+	config := route.WAF
+	mode := getWAFMode(config.Mode, "BLOCK")
+	block := mode == "BLOCK"
+	rules := compileWAFRules(config, mode)
+
+	forbiddenMethods := map[string]bool{}
+	for _, method := range config.ForbiddenMethods {
+		forbiddenMethods[strings.ToUpper(strings.TrimSpace(method))] = true
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			clientID := GetClientID(r, route)
+
+			if forbiddenMethods[r.Method] {
+				wafHit(r, route, clientID, "forbidden-method", block)
+				if block {
+					http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+					return
+				}
+			}
+
+			if config.MaxHeaderSize > 0 && getHeadersSize(r) > config.MaxHeaderSize {
+				wafHit(r, route, clientID, "max-header-size", block)
+				if block {
+					http.Error(w, "Request headers too large", http.StatusRequestHeaderFieldsTooLarge)
+					return
+				}
+			}
+
+			if config.MaxBodySize > 0 {
+				if r.ContentLength > config.MaxBodySize {
+					wafHit(r, route, clientID, "max-body-size", block)
+					if block {
+						http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+						return
+					}
+				} else if block && r.Body != nil {
+					// for the bodies without a length
+					r.Body = http.MaxBytesReader(w, r.Body, config.MaxBodySize)
+				} else if r.ContentLength < 0 && r.Body != nil && r.Body != http.NoBody {
+					r.Body = &wafBodyCounter{
+						ReadCloser: r.Body,
+						limit: config.MaxBodySize,
+						onLimit: func() {
+							wafHit(r, route, clientID, "max-body-size", false)
+						},
+					}
+				}
+			}
+
+			var body []byte
+			if config.InspectBody {
+				body, _ = peekRequestBody(r, wafMaxInspectedBody)
+			}
+
+			for _, rule := range rules {
+				if !rule.pattern.MatchString(wafTargetValue(r, rule, body)) {
+					continue
+				}
+
+				wafHit(r, route, clientID, rule.name, rule.block)
+				if rule.block {
+					http.Error(w, "Access denied: request blocked by the firewall.", http.StatusForbidden)
+					return
+				}
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -74,7 +74,7 @@ func FormatDiskRoute(w http.ResponseWriter, req *http.Request) {
 			
 		nickname := req.Header.Get("x-cosmos-user")
 
-		errp := utils.CheckPassword(nickname, request.Password)
+		errp := utils.CheckLoginPassword(req, nickname, request.Password)
 		if errp != nil {
 			utils.Error("FormatDiskRoute: Invalid User Request", errp)
 			fmt.Fprintf(w, utils.DoErr("[OPERATION FAILED] Wrong password supplied. Try again"))
@@ -58,3 +58,16 @@ The login was from the following IP: %s <br>
 On the following date: %s <br><br>
 `, nickname, ip, date.Format("2006-01-02 15:04:05")))
 }
+
+func SendAccountLockedEmail(nickname string, email string, ip string, until time.Time) error {
+	return utils.SendEmail(
+		[]string{email},
+		"Cosmos Account Locked",
+		fmt.Sprintf(`<h1>Account Locked</h1>
+Hello %s, <br>
+There were too many failed attempts to log into your account, it has been locked for a while. <br>
+If it wasn't you, please alert your server admin. <br><br>
+The last attempt was from the following IP: %s <br>
+Your account is locked until: %s <br><br>
+`, nickname, ip, until.Format("2006-01-02 15:04:05")))
+}
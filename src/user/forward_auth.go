@@ -0,0 +1,162 @@
+package user
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/aseracorp/resiOS/src/utils"
+)
+
+// headerCaptureWriter keeps the cookies and status set by RefreshUserToken without
+// sending its redirects or error bodies to the external proxy
+type headerCaptureWriter struct {
+	header http.Header
+	status int
+}
+
+func (w *headerCaptureWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *headerCaptureWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return len(b), nil
+}
+
+func (w *headerCaptureWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+// getForwardedURL rebuilds the URL the user requested on the external proxy
+// Traefik sends X-Forwarded-Proto/Host/Uri, nginx is usually configured with X-Original-URL
+func getForwardedURL(req *http.Request) (string, string) {
+	if original := req.Header.Get("X-Original-URL"); original != "" {
+		if parsed, err := url.Parse(original); err == nil && parsed.Host != "" {
+			return original, parsed.Host
+		}
+	}
+
+	host := req.Header.Get("X-Forwarded-Host")
+	if host == "" {
+		return "", ""
+	}
+
+	proto := req.Header.Get("X-Forwarded-Proto")
+	if proto == "" {
+		proto = "https"
+	}
+
+	uri := req.Header.Get("X-Forwarded-Uri")
+	if uri == "" {
+		uri = req.Header.Get("X-Original-URI")
+	}
+	if uri == "" {
+		uri = "/"
+	}
+
+	return proto + "://" + host + uri, host
+}
+
+func isQueryFlagSet(req *http.Request, name string) bool {
+	value := strings.ToLower(req.URL.Query().Get(name))
+	return value == "1" || value == "true" || value == "yes"
+}
+
+// ForwardAuthVerify lets external reverse proxies (nginx auth_request, Traefik ForwardAuth)
+// delegate authentication to Cosmos.
+// Query params: admin=1 to only allow admins, mfa=1 to require the user to have 2FA set up,
+// redirect=0 to answer 401/403 instead of redirecting to the login page (needed for nginx)
+func ForwardAuthVerify(w http.ResponseWriter, req *http.Request) {
+	// never trust identity headers coming from the outside
+	req.Header.Del("x-cosmos-user")
+	req.Header.Del("x-cosmos-role")
+	req.Header.Del("x-cosmos-mfa")
+
+	originalURL, originalHost := getForwardedURL(req)
+
+	adminOnly := isQueryFlagSet(req, "admin")
+	requireMFA := isQueryFlagSet(req, "mfa")
+	redirect := req.URL.Query().Get("redirect") != "0" && req.URL.Query().Get("redirect") != "false"
+
+	deny := func(status int, page string, reason string) {
+		utils.Debug("ForwardAuth: denied access to " + originalURL + ": " + reason)
+
+		if !redirect {
+			http.Error(w, reason, status)
+			return
+		}
+
+		loginURL := utils.GetServerURL("") + "resios-ui/" + page
+		if originalURL != "" {
+			loginURL += "&redirect=" + url.QueryEscape(originalURL)
+		}
+
+		http.Redirect(w, req, loginURL, http.StatusFound)
+	}
+
+	// the cookie was sent for the original host, validate the token against it
+	verifyReq := req.Clone(req.Context())
+	if originalHost != "" {
+		verifyReq.Host = originalHost
+	}
+
+	capture := &headerCaptureWriter{header: http.Header{}}
+	user, err := RefreshUserToken(capture, verifyReq)
+
+	// forward refreshed or cleared cookies
+	for _, cookie := range capture.header.Values("Set-Cookie") {
+		w.Header().Add("Set-Cookie", cookie)
+	}
+
+	if capture.status == http.StatusInternalServerError {
+		utils.HTTPError(w, "Authorization Error", http.StatusInternalServerError, "A001")
+		return
+	}
+
+	if err != nil {
+		deny(http.StatusUnauthorized, "login?invalid=1", "Unauthorized")
+		return
+	}
+
+	if user.Nickname == "" {
+		deny(http.StatusUnauthorized, "login?notlogged=1", "Unauthorized")
+		return
+	}
+
+	if user.MFAState == 1 {
+		deny(http.StatusUnauthorized, "loginmfa?invalid=1", "MFA required")
+		return
+	}
+
+	if user.MFAState == 2 || (requireMFA && (user.MFAKey == "" || !user.Was2FAVerified)) {
+		deny(http.StatusUnauthorized, "newmfa?invalid=1", "MFA not set")
+		return
+	}
+
+	if adminOnly && user.Role < utils.ADMIN {
+		// logging in again will not help, do not redirect
+		utils.Debug("ForwardAuth: " + user.Nickname + " is not an admin, denied access to " + originalURL)
+		utils.HTTPError(w, "Forbidden", http.StatusForbidden, "HTTP002")
+		return
+	}
+
+	w.Header().Set("X-Cosmos-User", user.Nickname)
+	w.Header().Set("X-Cosmos-Role", strconv.Itoa((int)(user.Role)))
+	w.Header().Set("X-Cosmos-Mfa", strconv.Itoa((int)(user.MFAState)))
+	w.Header().Set("Cache-Control", "no-store")
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": "OK",
+		"data": map[string]interface{}{
+			"nickname": user.Nickname,
+			"role": user.Role,
+		},
+	})
+}
@@ -45,6 +45,11 @@ func UserLogin(w http.ResponseWriter, req *http.Request) {
 
 		nickname := utils.Sanitize(request.Nickname)
 		password := request.Password
+		clientIP := utils.GetClientIP(req)
+
+		if delay := utils.LoginDelay(nickname, clientIP); delay > 0 {
+			time.Sleep(delay)
+		}
 
 		user := utils.User{}
 
@@ -56,6 +61,7 @@ func UserLogin(w http.ResponseWriter, req *http.Request) {
 
 		if err3 == mongo.ErrNoDocuments {
 			bcrypt.CompareHashAndPassword([]byte("$2a$14$4nzsVwEnR3.jEbMTME7kqeCo4gMgR/Tuk7ivNExvXjr73nKvLgHka"), []byte("dummyPassword"))
+			utils.RecordLoginFailure(req, nickname, false)
 			utils.Error("UserLogin: User not found", err3)
 			utils.HTTPError(w, "User Logging Error", http.StatusInternalServerError, "UL001")
 			return
@@ -68,18 +74,24 @@ func UserLogin(w http.ResponseWriter, req *http.Request) {
 			utils.Error("UserLogin: User not registered", nil)
 			utils.HTTPError(w, "User not registered", http.StatusUnauthorized, "UL002")
 			return
+		} else if utils.IsAccountLocked(user) {
+			utils.Error("UserLogin: Account " + nickname + " is locked until " + user.LockedUntil.Format(time.RFC3339), nil)
+			utils.HTTPError(w, "Account temporarily locked after too many failed logins", http.StatusTooManyRequests, "UL003")
+			return
 		} else {
 			err2 := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password))
 			if err2 != nil {
+				utils.RecordLoginFailure(req, nickname, true)
 				utils.Error("UserLogin: Encryption error", err2)
 				utils.HTTPError(w, "User Logging Error", http.StatusUnauthorized, "UL001")
 				return
 			}
 
+			utils.ClearLoginFailures(nickname, clientIP)
+
 			if utils.IsEmailEnabled() && utils.IsNotifyLoginEmailEnabled() && user.Email != "" {
-				clientIp := utils.GetClientIP(req)
 				date := time.Now()
-				if err := SendLoginNotificationEmail(user.Nickname, user.Email, clientIp, date); err != nil {
+				if err := SendLoginNotificationEmail(user.Nickname, user.Email, clientIP, date); err != nil {
 					utils.MajorError("UserLogin: Error while sending login notification email", err)
 				}
 			}
@@ -0,0 +1,60 @@
+package user
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/aseracorp/resiOS/src/utils"
+)
+
+// UserUnlock lifts the lock of an account before its end
+func UserUnlock(w http.ResponseWriter, req *http.Request) {
+	if utils.AdminOnly(w, req) != nil {
+		return
+	}
+
+	if(req.Method == "POST") {
+		nickname := utils.Sanitize(mux.Vars(req)["nickname"])
+
+		c, closeDb, errCo := utils.GetEmbeddedCollection(utils.GetRootAppId(), "users")
+		defer closeDb()
+		if errCo != nil {
+			utils.Error("Database Connect", errCo)
+			utils.HTTPError(w, "Database", http.StatusInternalServerError, "DB001")
+			return
+		}
+
+		result, err := c.UpdateOne(nil, map[string]interface{}{
+			"Nickname": nickname,
+		}, map[string]interface{}{
+			"$set": map[string]interface{}{
+				"LockedUntil": time.Time{},
+			},
+		})
+		if err != nil {
+			utils.Error("UserUnlock: Error while unlocking user", err)
+			utils.HTTPError(w, "User Unlock Error", http.StatusInternalServerError, "UL001")
+			return
+		}
+		if result.MatchedCount == 0 {
+			utils.Error("UserUnlock: User not found " + nickname, nil)
+			utils.HTTPError(w, "User not found", http.StatusNotFound, "UL001")
+			return
+		}
+
+		utils.ClearLoginFailures(nickname, "")
+
+		utils.Log("UserUnlock: " + req.Header.Get("x-cosmos-user") + " unlocked " + nickname)
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "OK",
+		})
+	} else {
+		utils.Error("UserUnlock: Method not allowed" + req.Method, nil)
+		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
+		return
+	}
+}
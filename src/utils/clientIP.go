@@ -0,0 +1,159 @@
+package utils
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// With the deprecated UseForwardedFor and no trusted proxies, only the loopback is trusted.
+// The private networks cannot be: behind a Docker bridge every client comes from the gateway
+var legacyTrustedProxies = []string{
+	"127.0.0.0/8",
+	"::1/128",
+}
+
+var trustedProxiesLock sync.Mutex
+var trustedProxiesKey string
+var trustedProxiesNets []*net.IPNet
+
+// ParseCIDRList accepts CIDRs and bare IPs, invalid entries are logged and skipped
+func ParseCIDRList(list []string) []*net.IPNet {
+	nets := []*net.IPNet{}
+	for _, entry := range list {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			if strings.Contains(entry, ":") {
+				entry += "/128"
+			} else {
+				entry += "/32"
+			}
+		}
+
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			Error("Invalid IP range " + entry, err)
+			continue
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets
+}
+
+func getTrustedProxies() []*net.IPNet {
+	HTTPConfig := GetMainConfig().HTTPConfig
+	list := HTTPConfig.TrustedProxies
+	if len(list) == 0 && HTTPConfig.UseForwardedFor {
+		list = legacyTrustedProxies
+	}
+
+	key := strings.Join(list, ",")
+
+	trustedProxiesLock.Lock()
+	defer trustedProxiesLock.Unlock()
+
+	if key != trustedProxiesKey || trustedProxiesNets == nil {
+		trustedProxiesNets = ParseCIDRList(list)
+		trustedProxiesKey = key
+	}
+
+	return trustedProxiesNets
+}
+
+func IsTrustedProxy(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+
+	for _, ipNet := range getTrustedProxies() {
+		if ipNet.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseForwardedNode reads one for= value of RFC 7239: 1.2.3.4, "1.2.3.4:80", "[2001:db8::1]:80", unknown or _obfuscated
+func parseForwardedNode(node string) string {
+	node = strings.Trim(strings.TrimSpace(node), "\"")
+	if ip := net.ParseIP(node); ip != nil {
+		return ip.String()
+	}
+
+	host, _ := SplitIP(node)
+	if host == "" && strings.HasPrefix(node, "[") && strings.HasSuffix(node, "]") {
+		host = strings.Trim(node, "[]")
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.String()
+	}
+
+	return ""
+}
+
+// getForwardedChain returns the client addresses added by each proxy, the closest proxy last.
+// Forwarded (RFC 7239) is preferred over X-Forwarded-For when both are set
+func getForwardedChain(r *http.Request) []string {
+	chain := []string{}
+
+	if forwarded := r.Header.Values("Forwarded"); len(forwarded) > 0 {
+		for _, element := range strings.Split(strings.Join(forwarded, ","), ",") {
+			node := ""
+			for _, pair := range strings.Split(element, ";") {
+				key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if ok && strings.EqualFold(key, "for") {
+					node = value
+				}
+			}
+			chain = append(chain, parseForwardedNode(node))
+		}
+		return chain
+	}
+
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		for _, node := range strings.Split(header, ",") {
+			chain = append(chain, parseForwardedNode(node))
+		}
+	}
+
+	return chain
+}
+
+// ResolveClientIP is the shared client IP resolver: the forwarding headers are read from right to left,
+// and only as long as the hop that wrote them is a trusted proxy
+func ResolveClientIP(r *http.Request) string {
+	return resolveClientIP(r, false)
+}
+
+// ResolveForwardedClientIP also trusts the direct peer, for connections already authenticated (e.g. Constellation tunnels)
+func ResolveForwardedClientIP(r *http.Request) string {
+	return resolveClientIP(r, true)
+}
+
+func resolveClientIP(r *http.Request, trustPeer bool) string {
+	clientIP, _ := SplitIP(r.RemoteAddr)
+
+	if !trustPeer && !IsTrustedProxy(clientIP) {
+		return clientIP
+	}
+
+	chain := getForwardedChain(r)
+	for i := len(chain) - 1; i >= 0; i-- {
+		// unknown or obfuscated, the chain cannot be followed further
+		if chain[i] == "" {
+			break
+		}
+
+		clientIP = chain[i]
+		if !IsTrustedProxy(clientIP) {
+			break
+		}
+	}
+
+	return clientIP
+}
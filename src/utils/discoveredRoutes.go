@@ -0,0 +1,30 @@
+package utils
+
+import (
+	"sync"
+)
+
+// Routes generated from the labels of the containers, they are never written to the config file
+var discoveredRoutesLock sync.RWMutex
+var discoveredRoutes = []ProxyRouteConfig{}
+
+func SetDiscoveredRoutes(routes []ProxyRouteConfig) {
+	discoveredRoutesLock.Lock()
+	defer discoveredRoutesLock.Unlock()
+
+	discoveredRoutes = routes
+}
+
+// GetDiscoveredRoutes is empty unless the routes from labels are allowed
+func GetDiscoveredRoutes() []ProxyRouteConfig {
+	if !GetMainConfig().DockerConfig.AllowLabelRoutes {
+		return []ProxyRouteConfig{}
+	}
+
+	discoveredRoutesLock.RLock()
+	defer discoveredRoutesLock.RUnlock()
+
+	routes := make([]ProxyRouteConfig, len(discoveredRoutes))
+	copy(routes, discoveredRoutes)
+	return routes
+}
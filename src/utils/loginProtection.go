@@ -0,0 +1,284 @@
+package utils
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// the delay before answering doubles with every failure, up to loginMaxDelay
+const loginBaseDelay = 500 * time.Millisecond
+const loginMaxDelay = 16 * time.Second
+
+// the accounts and the IPs remembered at most, each
+const loginTrackerMaxEntries = 10000
+
+var ErrAccountLocked = errors.New("Account locked after too many failed logins")
+
+// NotifyAccountLocked emails the owner of a locked account, set by the user package
+var NotifyAccountLocked func(nickname string, email string, clientIP string, until time.Time) error
+
+type loginFailures struct {
+	count int
+	last time.Time
+}
+
+type loginTracker struct {
+	sync.Mutex
+	accounts map[string]*loginFailures
+	ips map[string]*loginFailures
+}
+
+var failedLogins = loginTracker{
+	accounts: map[string]*loginFailures{},
+	ips: map[string]*loginFailures{},
+}
+
+type loginProtection struct {
+	maxFailures int
+	lockDuration time.Duration
+	maxIPFailures int
+	failureWindow time.Duration
+}
+
+func getLoginProtection() loginProtection {
+	config := GetMainConfig().LoginProtection
+
+	protection := loginProtection{
+		maxFailures: config.MaxFailures,
+		lockDuration: time.Duration(config.LockDuration) * time.Minute,
+		maxIPFailures: config.MaxIPFailures,
+		failureWindow: time.Duration(config.FailureWindow) * time.Minute,
+	}
+
+	if protection.maxFailures <= 0 {
+		protection.maxFailures = 5
+	}
+	if protection.lockDuration <= 0 {
+		protection.lockDuration = 15 * time.Minute
+	}
+	if protection.maxIPFailures <= 0 {
+		protection.maxIPFailures = 10
+	}
+	if protection.failureWindow <= 0 {
+		protection.failureWindow = 15 * time.Minute
+	}
+
+	return protection
+}
+
+// count is the number of recent failures, the caller holds the lock
+func (tracker *loginTracker) count(failures map[string]*loginFailures, key string, window time.Duration) int {
+	entry, ok := failures[key]
+	if !ok {
+		return 0
+	}
+	if time.Since(entry.last) > window {
+		delete(failures, key)
+		return 0
+	}
+	return entry.count
+}
+
+// add records a failure and returns the number of recent ones, the caller holds the lock
+func (tracker *loginTracker) add(failures map[string]*loginFailures, key string, window time.Duration) int {
+	count := tracker.count(failures, key, window) + 1
+	failures[key] = &loginFailures{
+		count: count,
+		last: time.Now(),
+	}
+
+	if len(failures) > loginTrackerMaxEntries {
+		tracker.prune(failures, window)
+	}
+
+	return count
+}
+
+// prune forgets the expired entries, then the oldest ones until there is room again, the caller holds the lock
+func (tracker *loginTracker) prune(failures map[string]*loginFailures, window time.Duration) {
+	for k, entry := range failures {
+		if time.Since(entry.last) > window {
+			delete(failures, k)
+		}
+	}
+
+	// a flood of failures from many IPs, evict below the cap so this does not run on every failure
+	if len(failures) > loginTrackerMaxEntries * 9 / 10 {
+		keys := make([]string, 0, len(failures))
+		for k := range failures {
+			keys = append(keys, k)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			return failures[keys[i]].last.Before(failures[keys[j]].last)
+		})
+		for _, k := range keys[:len(keys) - loginTrackerMaxEntries * 9 / 10] {
+			delete(failures, k)
+		}
+	}
+}
+
+// LoginDelay is how long to wait before checking a password, from the recent failures of the account and the IP
+func LoginDelay(nickname string, clientIP string) time.Duration {
+	if GetMainConfig().LoginProtection.Disabled {
+		return 0
+	}
+
+	protection := getLoginProtection()
+
+	failedLogins.Lock()
+	count := failedLogins.count(failedLogins.accounts, nickname, protection.failureWindow)
+	if ipCount := failedLogins.count(failedLogins.ips, clientIP, protection.failureWindow); ipCount > count {
+		count = ipCount
+	}
+	failedLogins.Unlock()
+
+	if count == 0 {
+		return 0
+	}
+
+	delay := loginBaseDelay
+	for i := 1; i < count && delay < loginMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > loginMaxDelay {
+		delay = loginMaxDelay
+	}
+
+	return delay
+}
+
+func IsAccountLocked(user User) bool {
+	return !GetMainConfig().LoginProtection.Disabled && time.Now().Before(user.LockedUntil)
+}
+
+// RecordLoginFailure counts a failed login, exists is false if the account does not exist.
+// It locks the account and strikes the IP once they are over the limits
+func RecordLoginFailure(req *http.Request, nickname string, exists bool) {
+	clientIP := GetClientIP(req)
+
+	if GetMainConfig().LoginProtection.Disabled {
+		return
+	}
+
+	protection := getLoginProtection()
+
+	failedLogins.Lock()
+	accountFailures := failedLogins.add(failedLogins.accounts, nickname, protection.failureWindow)
+	ipFailures := failedLogins.add(failedLogins.ips, clientIP, protection.failureWindow)
+
+	lock := exists && accountFailures >= protection.maxFailures
+	if lock {
+		delete(failedLogins.accounts, nickname)
+	}
+
+	strike := ipFailures >= protection.maxIPFailures
+	if strike {
+		delete(failedLogins.ips, clientIP)
+	}
+	failedLogins.Unlock()
+
+	Warn("Login: Failed login for " + nickname + " from " + clientIP + " on " + req.URL.Path + " (" + strconv.Itoa(accountFailures) + " failures)")
+
+	TriggerEvent(
+		"cosmos.user.login.failed",
+		"Failed login for " + nickname,
+		"warning",
+		"",
+		map[string]interface{}{
+		"nickname": nickname,
+		"clientID": clientIP,
+		"path": req.URL.Path,
+		"failures": accountFailures,
+		"ipFailures": ipFailures,
+		"locked": lock,
+	})
+
+	if strike && ShieldStrikeClient != nil {
+		ShieldStrikeClient(clientIP, "login", strconv.Itoa(ipFailures) + " failed logins")
+	}
+
+	if lock {
+		lockAccount(nickname, clientIP, protection.lockDuration)
+	}
+}
+
+func lockAccount(nickname string, clientIP string, duration time.Duration) {
+	lockedUntil := time.Now().Add(duration)
+
+	c, closeDb, errCo := GetEmbeddedCollection(GetRootAppId(), "users")
+	defer closeDb()
+	if errCo != nil {
+		Error("Login: Cannot lock account " + nickname, errCo)
+		return
+	}
+
+	_, err := c.UpdateOne(nil, map[string]interface{}{
+		"Nickname": nickname,
+	}, map[string]interface{}{
+		"$set": map[string]interface{}{
+			"LockedUntil": lockedUntil,
+		},
+	})
+	if err != nil {
+		Error("Login: Cannot lock account " + nickname, err)
+		return
+	}
+
+	Warn("Login: Account " + nickname + " is locked until " + lockedUntil.Format(time.RFC3339) + " after too many failed logins")
+
+	if !IsEmailEnabled() || NotifyAccountLocked == nil {
+		return
+	}
+
+	user := User{}
+	err = c.FindOne(nil, map[string]interface{}{
+		"Nickname": nickname,
+	}).Decode(&user)
+	if err != nil || user.Email == "" {
+		return
+	}
+
+	if err := NotifyAccountLocked(user.Nickname, user.Email, clientIP, lockedUntil); err != nil {
+		MajorError("Login: Error while sending account locked email", err)
+	}
+}
+
+func ClearLoginFailures(nickname string, clientIP string) {
+	failedLogins.Lock()
+	defer failedLogins.Unlock()
+
+	delete(failedLogins.accounts, nickname)
+	if clientIP != "" {
+		delete(failedLogins.ips, clientIP)
+	}
+}
+
+// CheckLoginPassword is CheckPassword behind the protection of the login page:
+// the delay, the failure counting and the lock of the account
+func CheckLoginPassword(req *http.Request, nickname string, password string) error {
+	clientIP := GetClientIP(req)
+
+	if delay := LoginDelay(nickname, clientIP); delay > 0 {
+		time.Sleep(delay)
+	}
+
+	err := CheckPassword(nickname, password)
+
+	switch {
+	case err == nil:
+		ClearLoginFailures(nickname, clientIP)
+	case err == mongo.ErrNoDocuments:
+		RecordLoginFailure(req, nickname, false)
+	case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
+		RecordLoginFailure(req, nickname, true)
+	}
+
+	return err
+}
@@ -0,0 +1,98 @@
+package utils
+
+import (
+	"sync"
+	"time"
+)
+
+// MaintenanceState is kept in memory, it is lost when Cosmos restarts
+type MaintenanceState struct {
+	Enabled bool `json:"enabled"`
+	Message string `json:"message"`
+	RetryAfter int `json:"retryAfter"` // seconds
+	Reason string `json:"reason"`
+	Since time.Time `json:"since"`
+}
+
+// "*" puts every route in maintenance
+const MaintenanceAllRoutes = "*"
+
+var maintenanceLock sync.RWMutex
+var maintenanceRoutes = map[string]MaintenanceState{}
+var maintenanceContainers = map[string]MaintenanceState{}
+
+func SetRouteMaintenance(route string, state MaintenanceState) {
+	maintenanceLock.Lock()
+	defer maintenanceLock.Unlock()
+
+	if !state.Enabled {
+		delete(maintenanceRoutes, route)
+		return
+	}
+
+	if state.Since.IsZero() {
+		state.Since = time.Now()
+	}
+	maintenanceRoutes[route] = state
+}
+
+// SetContainerMaintenance is used while a container is being updated or recreated
+func SetContainerMaintenance(container string, enabled bool) {
+	maintenanceLock.Lock()
+	defer maintenanceLock.Unlock()
+
+	if !enabled {
+		delete(maintenanceContainers, container)
+		return
+	}
+
+	maintenanceContainers[container] = MaintenanceState{
+		Enabled: true,
+		Message: "This service is being updated and will be back in a moment.",
+		RetryAfter: 30,
+		Reason: "container",
+		Since: time.Now(),
+	}
+}
+
+func GetRouteMaintenance(route string) (MaintenanceState, bool) {
+	maintenanceLock.RLock()
+	defer maintenanceLock.RUnlock()
+
+	if state, ok := maintenanceRoutes[route]; ok {
+		return state, true
+	}
+	if state, ok := maintenanceRoutes[MaintenanceAllRoutes]; ok {
+		return state, true
+	}
+
+	return MaintenanceState{}, false
+}
+
+func GetContainerMaintenance(container string) (MaintenanceState, bool) {
+	maintenanceLock.RLock()
+	defer maintenanceLock.RUnlock()
+
+	state, ok := maintenanceContainers[container]
+	return state, ok
+}
+
+func GetMaintenanceStatus() map[string]interface{} {
+	maintenanceLock.RLock()
+	defer maintenanceLock.RUnlock()
+
+	routes := map[string]MaintenanceState{}
+	for name, state := range maintenanceRoutes {
+		routes[name] = state
+	}
+
+	containers := map[string]MaintenanceState{}
+	for name, state := range maintenanceContainers {
+		containers[name] = state
+	}
+
+	return map[string]interface{}{
+		"routes": routes,
+		"containers": containers,
+	}
+}
@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"bufio"
 	"context"
 	"net/http"
 	"time"
@@ -19,6 +20,9 @@ import (
 
 var PushShieldMetrics func(string)
 
+// ShieldStrikeClient gives a SmartShield strike to a client, set by the proxy
+var ShieldStrikeClient func(clientID string, route string, reason string)
+
 type safeInt struct {
 	val int64
 }
@@ -48,10 +52,15 @@ func GetIPAbuseCounter(ip string) int64 {
 	return atomic.LoadInt64(&counter.val)
 }
 
+// ResetIPAbuseCounter forgives an IP, once its bans are lifted by an admin
+func ResetIPAbuseCounter(ip string) {
+	BannedIPs.Delete(ip)
+}
+
 func BlockBannedIPs(next http.Handler) http.Handler {
     return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-        ip, _, err := net.SplitHostPort(r.RemoteAddr)
-        if err != nil {
+        ip := GetClientIP(r)
+        if ip == "" {
 					if hj, ok := w.(http.Hijacker); ok {
 							conn, _, err := hj.Hijack()
 							if err == nil {
@@ -120,6 +129,20 @@ func (w *responseWriter) Write(b []byte) (int, error) {
 	return w.Writer.Write(b)
 }
 
+func (w *responseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	return hijacker.Hijack()
+}
+
 func BandwithLimiterMiddleware(max int64) func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -212,8 +235,8 @@ func GetIPLocation(ip string) (string, error) {
 func BlockByCountryMiddleware(blockedCountries []string, CountryBlacklistIsWhitelist bool) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			ip, _, err := net.SplitHostPort(r.RemoteAddr)
-			if err != nil {
+			ip := GetClientIP(r)
+			if ip == "" {
 				http.Error(w, "Invalid request", http.StatusBadRequest)
 				return
 			}
@@ -297,7 +320,7 @@ func BlockPostWithoutReferer(next http.Handler) http.Handler {
 				Error("Blocked POST request without Referer header", nil)
 				http.Error(w, "Bad Request: Invalid request.", http.StatusBadRequest)
 
-				ip, _, _ := net.SplitHostPort(r.RemoteAddr)
+				ip := GetClientIP(r)
 				if ip != "" {
 					TriggerEvent(
 						"cosmos.proxy.shield.referer",
@@ -357,7 +380,7 @@ func EnsureHostname(next http.Handler) http.Handler {
 			w.WriteHeader(http.StatusBadRequest)
 			http.Error(w, "Bad Request: Invalid hostname. Use your domain instead of your IP to access your server. Check logs if more details are needed.", http.StatusBadRequest)
 			
-			ip, _, _ := net.SplitHostPort(r.RemoteAddr)
+			ip := GetClientIP(r)
 			if ip != "" {
 				TriggerEvent(
 					"cosmos.proxy.shield.hostname",
@@ -423,7 +446,7 @@ func EnsureHostnameCosmosAPI(next http.Handler) http.Handler {
 			w.WriteHeader(http.StatusBadRequest)
 			http.Error(w, "Bad Request: Invalid hostname. Use your domain instead of your IP to access your server. Check logs if more details are needed.", http.StatusBadRequest)
 			
-			ip, _, _ := net.SplitHostPort(r.RemoteAddr)
+			ip := GetClientIP(r)
 			if ip != "" {
 				TriggerEvent(
 					"cosmos.proxy.shield.hostname",
@@ -494,8 +517,8 @@ func Restrictions(RestrictToConstellation bool, WhitelistInboundIPs []string) fu
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
-		ip, _, err := net.SplitHostPort(r.RemoteAddr)
-		if err != nil {
+		ip := GetClientIP(r)
+		if ip == "" {
 			http.Error(w, "Invalid request", http.StatusBadRequest)
 			return
 		}
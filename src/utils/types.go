@@ -40,6 +40,73 @@ var ProxyModeList = map[string]string{
 	"REDIRECT": "REDIRECT",
 }
 
+// COMMON and COMBINED are the NCSA formats read by GoAccess, fail2ban, awstats...
+var AccessLogFormatList = map[string]string{
+	"JSON": "JSON",
+	"COMMON": "COMMON",
+	"COMBINED": "COMBINED",
+}
+
+var WAFModeList = map[string]string{
+	"BLOCK": "BLOCK",
+	"DETECT": "DETECT",
+}
+
+var WAFRuleSetList = map[string]string{
+	"PATH_TRAVERSAL": "PATH_TRAVERSAL",
+	"SQLI": "SQLI",
+	"XSS": "XSS",
+	"BAD_USER_AGENTS": "BAD_USER_AGENTS",
+}
+
+var WAFRuleTargetList = map[string]string{
+	"PATH": "PATH",
+	"QUERY": "QUERY",
+	"URI": "URI",
+	"HEADER": "HEADER",
+	"USER_AGENT": "USER_AGENT",
+	"METHOD": "METHOD",
+	"BODY": "BODY",
+}
+
+var ChallengeModeList = map[string]string{
+	"SUSPECTED": "SUSPECTED",
+	"ALL": "ALL",
+}
+
+var ProxyProtocolVersionList = map[string]string{
+	"v1": "v1",
+	"v2": "v2",
+}
+
+var LoadBalancingStrategyList = map[string]string{
+	"ROUND_ROBIN": "ROUND_ROBIN",
+	"LEAST_CONN": "LEAST_CONN",
+	"IP_HASH": "IP_HASH",
+	"WEIGHTED": "WEIGHTED",
+}
+
+// HTTP is HTTP/1.1, or HTTP/2 when negotiated with TLS. H2C is HTTP/2 without TLS
+// GRPC is HTTP/2 (H2C for http:// and unix:// targets) with streaming and gRPC errors
+var UpstreamProtocolList = map[string]string{
+	"HTTP": "HTTP",
+	"H2C": "H2C",
+	"GRPC": "GRPC",
+}
+
+var HeaderRuleTargetList = map[string]string{
+	"REQUEST": "REQUEST",
+	"RESPONSE": "RESPONSE",
+	"COOKIE": "COOKIE",
+}
+
+var HeaderRuleActionList = map[string]string{
+	"SET": "SET",
+	"ADD": "ADD",
+	"REMOVE": "REMOVE",
+	"REPLACE": "REPLACE",
+}
+
 var HTTPSCertModeList = map[string]string{
 	"DISABLED": "DISABLED",
 	"PROVIDED": "PROVIDED",
@@ -74,6 +141,8 @@ type User struct {
 	Was2FAVerified bool `json:"-" bson:"Was2FAVerified"`
 	MFAState int `json:"-" bson:"-"` 
 	// 0 = done, 1 = needed, 2 = not set
+	// set by the login protection after too many failed logins
+	LockedUntil time.Time `json:"lockedUntil" bson:"LockedUntil"`
 }
 
 type Config struct {
@@ -89,6 +158,7 @@ type Config struct {
 	CountryBlacklistIsWhitelist bool
 	ServerCountry string
 	RequireMFA bool
+	LoginProtection LoginProtectionConfig
 	AutoUpdate bool
 	BetaUpdates bool
 	OpenIDClients []OpenIDClient
@@ -110,6 +180,19 @@ type Config struct {
 }
 
 
+// LoginProtectionConfig slows down and locks out the brute-forcing of the login, 0 keeps the default
+type LoginProtectionConfig struct {
+	Disabled bool
+	// failed logins of an account before it is locked, 5 by default
+	MaxFailures int
+	// minutes the account stays locked, 15 by default
+	LockDuration int
+	// failed logins from an IP, over all the accounts, before it gets a SmartShield strike, 10 by default
+	MaxIPFailures int
+	// minutes a failed login is remembered, 15 by default
+	FailureWindow int
+}
+
 type CRONConfig struct {
 	Enabled bool
 	Name string
@@ -175,9 +258,21 @@ type HTTPConfig struct {
 	AcceptAllInsecureHostname bool
 	DNSChallengeConfig map[string]string `json:"DNSChallengeConfig,omitempty"`
 	DNSChallengeResolvers string
+	// Deprecated: use TrustedProxies, when set alone it only trusts the loopback
 	UseForwardedFor bool
+	// IPs or CIDRs of the reverse proxies in front of Cosmos, allowed to set X-Forwarded-For and Forwarded
+	TrustedProxies []string `json:"TrustedProxies,omitempty"`
+	// HTTP/3 over QUIC on the UDP side of the HTTPS port, advertised with Alt-Svc
+	EnableHTTP3 bool
 	AllowSearchEngine bool
 	PublishMDNS bool
+	// PROXY protocol v1/v2 on the HTTP and HTTPS listeners, for servers behind a TCP load balancer
+	AcceptProxyProtocol bool
+	// IPs or CIDRs allowed to send a PROXY protocol header, also used by the socket proxies. Nobody is trusted when empty
+	ProxyProtocolTrustedIPs []string `json:"ProxyProtocolTrustedIPs,omitempty"`
+	// defaults of the escalation, allowlist and never ban admins settings of the routes, the rest is per route.
+	// The allowlist defaults to the usual gateway IPs when not set
+	SmartShield SmartShieldPolicy
 } 
 
 const (
@@ -194,12 +289,33 @@ type SmartShieldPolicy struct {
 	PerUserSimultaneous int 	`yaml:"per_user_simultaneous"`
 	MaxGlobalSimultaneous int `yaml:"max_global_simultaneous"`
 	PrivilegedGroups int `yaml:"privileged_groups"`
+	Escalation SmartShieldEscalation `yaml:"escalation"`
+	// IPs or CIDRs never banned, on top of the global ones
+	Allowlist []string `yaml:"allowlist"`
+	// admins logged in are never banned, they can still be throttled
+	NeverBanAdmins bool `yaml:"never_ban_admins"`
+}
+
+// SmartShieldEscalation is the ladder from strikes to permanent bans, 0 keeps the global value or the default
+type SmartShieldEscalation struct {
+	// minutes a strike blocks the client, 60 by default
+	StrikeDuration int `yaml:"strike_duration"`
+	// strikes within StrikeWindow hours leading to a temporary ban, 3 in 24 by default, -1 never bans temporarily
+	StrikesBeforeTempBan int `yaml:"strikes_before_temp_ban"`
+	StrikeWindow int `yaml:"strike_window"`
+	// minutes a temporary ban blocks the client, 240 by default
+	TempBanDuration int `yaml:"temp_ban_duration"`
+	// temporary bans within TempBanWindow hours leading to a permanent ban, 3 in 72 by default, -1 never bans permanently
+	TempBansBeforePermBan int `yaml:"temp_bans_before_perm_ban"`
+	TempBanWindow int `yaml:"temp_ban_window"`
 }
 
 type DockerConfig struct {
 	SkipPruneNetwork bool
 	SkipPruneImages bool
 	DefaultDataPath string
+	// create the routes requested by the cosmos.route.* labels of the containers, off by default
+	AllowLabelRoutes bool
 }
 
 type ProxyConfig struct {
@@ -212,6 +328,154 @@ type AddionalFiltersConfig struct {
 	Value string `yaml:"value"`
 }
 
+type ProxyTargetConfig struct {
+	Target string `yaml:"target" validate:"required"`
+	// relative share of the traffic, a target with a match rule and no weight only gets the matching requests
+	Weight int    `yaml:"weight"`
+	// used in the metrics and the sticky cookie, defaults to the target
+	Name   string `yaml:"name,omitempty"`
+	// requests with this header or cookie (and this value, if set) always go to this target
+	MatchHeader string `yaml:"match_header,omitempty"`
+	MatchCookie string `yaml:"match_cookie,omitempty"`
+	MatchValue  string `yaml:"match_value,omitempty"`
+}
+
+type ProxyHealthCheckConfig struct {
+	Enabled            bool   `yaml:"enabled"`
+	Type               string `yaml:"type"` // HTTP or TCP
+	Path               string `yaml:"path,omitempty"`
+	Interval           int    `yaml:"interval"` // seconds
+	Timeout            int    `yaml:"timeout"` // seconds
+	ExpectedStatus     int    `yaml:"expected_status"`
+	HealthyThreshold   int    `yaml:"healthy_threshold"`
+	UnhealthyThreshold int    `yaml:"unhealthy_threshold"`
+}
+
+type ProxyCacheConfig struct {
+	Enabled        bool  `yaml:"enabled"`
+	MaxMemoryBytes int64 `yaml:"max_memory_bytes"`
+	MaxObjectBytes int64 `yaml:"max_object_bytes"`
+	DefaultTTL     int   `yaml:"default_ttl"` // seconds, used when the backend does not specify any freshness
+	UseDisk        bool  `yaml:"use_disk"`
+	MaxDiskBytes   int64 `yaml:"max_disk_bytes"`
+}
+
+type ProxyCompressionConfig struct {
+	Enabled      bool     `yaml:"enabled"`
+	Algorithms   []string `yaml:"algorithms,omitempty"` // by order of preference, among zstd, br (brotli) and gzip
+	ContentTypes []string `yaml:"content_types,omitempty"`
+	MinSize      int      `yaml:"min_size"` // bytes
+	Level        int      `yaml:"level"`
+}
+
+type ProxyPathRewrite struct {
+	Match   string `yaml:"match"` // regex on the request path, with capture groups
+	Replace string `yaml:"replace"` // ex: /api/$1
+}
+
+// Value supports the variables {client_ip}, {user}, {role}, {route}, {host}, {path}, {method} and {scheme}
+type ProxyHeaderRule struct {
+	Target    string `yaml:"target"` // REQUEST, RESPONSE or COOKIE (Set-Cookie attributes of the response)
+	Action    string `yaml:"action"` // SET, ADD, REMOVE or REPLACE
+	Name      string `yaml:"name"` // header name, or cookie name (* for all) for COOKIE
+	Attribute string `yaml:"attribute,omitempty"` // COOKIE only: Domain, Path, SameSite, Secure...
+	Match     string `yaml:"match,omitempty"` // regex used by REPLACE
+	Value     string `yaml:"value,omitempty"`
+}
+
+type ProxyErrorPagesConfig struct {
+	Enabled         bool  `yaml:"enabled"`
+	InterceptStatus []int `yaml:"intercept_status,omitempty"` // backend statuses replaced by the error pages, 500, 502, 503 and 504 if empty
+}
+
+type ProxyForwardAuthConfig struct {
+	Enabled             bool     `yaml:"enabled"`
+	Address             string   `yaml:"address"`
+	AuthRequestHeaders  []string `yaml:"auth_request_headers,omitempty"` // headers sent to the provider, all of them but the Cosmos credentials if empty
+	AuthResponseHeaders []string `yaml:"auth_response_headers,omitempty"` // headers copied from the provider into the upstream request
+	Timeout             int      `yaml:"timeout"` // seconds
+	AcceptInsecureHTTPS bool     `yaml:"accept_insecure_https"`
+}
+
+type ProxyAccessLogConfig struct {
+	Enabled    bool   `yaml:"enabled"`
+	Format     string `yaml:"format"` // JSON, COMMON or COMBINED
+	MaxSize    int    `yaml:"max_size"` // megabytes
+	MaxBackups int    `yaml:"max_backups"`
+	MaxAge     int    `yaml:"max_age"` // days
+}
+
+type ProxyWAFRule struct {
+	Name     string `yaml:"name"`
+	Target   string `yaml:"target"` // PATH, QUERY, URI, HEADER, USER_AGENT, METHOD or BODY
+	Header   string `yaml:"header,omitempty"` // for the HEADER target
+	Pattern  string `yaml:"pattern"` // regular expression, case insensitive
+	Mode     string `yaml:"mode,omitempty"` // overrides the mode of the WAF for this rule
+	Disabled bool   `yaml:"disabled"`
+}
+
+type ProxyWAFConfig struct {
+	Enabled          bool           `yaml:"enabled"`
+	Mode             string         `yaml:"mode"` // BLOCK or DETECT, which only logs the hits
+	DisabledRuleSets []string       `yaml:"disabled_rule_sets,omitempty"` // PATH_TRAVERSAL, SQLI, XSS or BAD_USER_AGENTS
+	ForbiddenMethods []string       `yaml:"forbidden_methods,omitempty"`
+	MaxBodySize      int64          `yaml:"max_body_size"` // bytes, no limit if 0
+	MaxHeaderSize    int            `yaml:"max_header_size"` // bytes of all the headers, no limit if 0
+	InspectBody      bool           `yaml:"inspect_body"` // the first 64KB of the body go through the SQLI, XSS and BODY rules
+	Rules            []ProxyWAFRule `yaml:"rules,omitempty"`
+}
+
+type ProxyChallengeConfig struct {
+	Enabled    bool   `yaml:"enabled"`
+	Mode       string `yaml:"mode"` // SUSPECTED, the clients flagged by the shield, or ALL the clients without a session
+	Difficulty int    `yaml:"difficulty"` // leading zero bits of the proof of work, 16 by default
+	Duration   int    `yaml:"duration"` // minutes the client is let through once solved, 60 by default
+}
+
+type ProxyBasicAuthConfig struct {
+	Enabled     bool              `yaml:"enabled"`
+	CosmosUsers bool              `yaml:"cosmos_users"` // accept the Cosmos accounts, except the ones with MFA
+	Users       map[string]string `yaml:"users,omitempty"` // route specific credentials, user: bcrypt hash (htpasswd -B)
+	Realm       string            `yaml:"realm,omitempty"`
+}
+
+// The token itself is only shown once, when it is created
+type ProxyBearerToken struct {
+	Name      string    `yaml:"name"`
+	Hash      string    `yaml:"hash"` // hex SHA-256 of the token
+	CreatedAt time.Time `yaml:"created_at"`
+	ExpiresAt time.Time `yaml:"expires_at,omitempty"` // never if zero
+}
+
+// A window is either a cron expression, open during every minute it matches (ex: "* 16-19 * * 1-5"),
+// or days and a time range. End can be before Start to go past midnight
+type ProxyScheduleWindow struct {
+	Cron  string   `yaml:"cron,omitempty"`
+	Days  []string `yaml:"days,omitempty"` // mon, tue... every day if empty
+	Start string   `yaml:"start,omitempty"` // HH:MM
+	End   string   `yaml:"end,omitempty"` // HH:MM, excluded
+}
+
+type ProxyAccessScheduleConfig struct {
+	Enabled     bool                  `yaml:"enabled"`
+	Timezone    string                `yaml:"timezone,omitempty"` // IANA name, ex: Europe/Paris. Server time if empty
+	Windows     []ProxyScheduleWindow `yaml:"windows,omitempty"` // the route is only reachable inside one of them
+	ExemptUsers []string              `yaml:"exempt_users,omitempty"`
+	ExemptRole  Role                  `yaml:"exempt_role"` // users with this role or above are always let in, nobody if 0
+	Message     string                `yaml:"message,omitempty"`
+}
+
+type ProxyMirrorConfig struct {
+	Enabled             bool   `yaml:"enabled"`
+	Target              string `yaml:"target"`
+	Percentage          int    `yaml:"percentage"` // share of the requests mirrored, 1 to 100, none if 0
+	MaxBodySize         int64  `yaml:"max_body_size"` // bytes, requests with a bigger body are not mirrored
+	Timeout             int    `yaml:"timeout"` // seconds
+	AcceptInsecureHTTPS bool   `yaml:"accept_insecure_https"`
+	// the Authorization and Cookie headers are removed from the copies unless set
+	ForwardCredentials  bool   `yaml:"forward_credentials"`
+}
+
 type ProxyRouteConfig struct {
 	Disabled                   bool                        `yaml:"disabled"`
 	Name                       string                      `yaml:"name" validate:"required"`
@@ -227,6 +491,7 @@ type ProxyRouteConfig struct {
 	MaxBandwith                int64                       `yaml:"max_bandwidth"`
 	AuthEnabled                bool                        `yaml:"auth_enabled"`
 	AdminOnly                  bool                        `yaml:"admin_only"`
+	// http(s)://host:port, unix:///path/to.sock or unix://container/path/in/container.sock
 	Target                     string                      `yaml:"target" validate:"required"`
 	SmartShield                SmartShieldPolicy           `yaml:"smart_shield"`
 	Mode                       ProxyMode                   `yaml:"mode"`
@@ -244,6 +509,41 @@ type ProxyRouteConfig struct {
 	TunnelVia                  string                      `yaml:"tunnel_via,omitempty"`
 	TunneledHost							 string                      `yaml:"tunneled_host,omitempty"`
 	ExtraHeaders               map[string]string           `yaml:"extra_headers,omitempty"`
+	// If set, overrides Target and spreads the requests across all the upstreams
+	Targets                    []ProxyTargetConfig         `yaml:"targets,omitempty"`
+	LoadBalancingStrategy      string                      `yaml:"load_balancing_strategy,omitempty"`
+	// a client keeps the target it was first sent to, with a cookie
+	StickySessions             bool                        `yaml:"sticky_sessions"`
+	HealthCheck                ProxyHealthCheckConfig      `yaml:"health_check"`
+	Cache                      ProxyCacheConfig            `yaml:"cache"`
+	Compression                ProxyCompressionConfig      `yaml:"compression"`
+	ForwardAuth                ProxyForwardAuthConfig      `yaml:"forward_auth"`
+	// copies of the requests sent to a secondary upstream, the answers are discarded
+	Mirror                     ProxyMirrorConfig           `yaml:"mirror"`
+	AccessSchedule             ProxyAccessScheduleConfig   `yaml:"access_schedule"`
+	// alternatives to the login cookie on AuthEnabled routes, for the clients that cannot follow the login redirect
+	BasicAuth                  ProxyBasicAuthConfig        `yaml:"basic_auth"`
+	BearerTokens               []ProxyBearerToken          `yaml:"bearer_tokens,omitempty"`
+	// written in access-logs/<route>.log in the config folder
+	AccessLog                  ProxyAccessLogConfig        `yaml:"access_log"`
+	WAF                        ProxyWAFConfig              `yaml:"waf"`
+	// proof of work asked in the browser before reaching the route, no external service involved
+	Challenge                  ProxyChallengeConfig        `yaml:"challenge"`
+	HeaderRules                []ProxyHeaderRule           `yaml:"header_rules,omitempty"`
+	UsePathRegex               bool                        `yaml:"use_path_regex"`
+	PathRegex                  string                      `yaml:"path_regex,omitempty"`
+	// applied in order after the path prefix is stripped, the first matching rule wins
+	PathRewrites               []ProxyPathRewrite          `yaml:"path_rewrites,omitempty"`
+	RewriteLocation            bool                        `yaml:"rewrite_location"`
+	RewriteBaseHref            bool                        `yaml:"rewrite_base_href"`
+	ErrorPages                 ProxyErrorPagesConfig       `yaml:"error_pages"`
+	UpstreamProtocol           string                      `yaml:"upstream_protocol,omitempty"`
+	// raw TLS is forwarded to the target by SNI on the HTTPS port, without being terminated.
+	// A *.example.com host does not match example.com, list both to pass the apex through
+	TLSPassthrough             bool                        `yaml:"tls_passthrough"`
+	// socket proxies only
+	AcceptProxyProtocol        bool                        `yaml:"accept_proxy_protocol"`
+	SendProxyProtocol          string                      `yaml:"send_proxy_protocol,omitempty"`
 }
 
 type EmailConfig struct {
@@ -354,6 +354,13 @@ func SanitizeSafe(s string) string {
 	return strings.TrimSpace(s)
 }
 
+var nameSanitizerRegexp = regexp.MustCompile(`[^a-zA-Z0-9_-]+`)
+
+// SanitizeName keeps the names safe for the metrics keys, the cookies and the file names
+func SanitizeName(name string) string {
+	return nameSanitizerRegexp.ReplaceAllString(name, "_")
+}
+
 func GetConfigFileName() string {	
 	configFile := os.Getenv("CONFIG_FILE")
 
@@ -477,9 +484,10 @@ func GetAllHostnames(applyWildCard bool, removePorts bool) []string {
 
 	proxies := GetMainConfig().ConstellationConfig.Tunnels
 	proxies = append(proxies, GetMainConfig().HTTPConfig.ProxyConfig.Routes...)
+	proxies = append(proxies, GetDiscoveredRoutes()...)
 	
 	for _, proxy := range proxies {
-		if proxy.UseHost && proxy.Host != "" && !strings.Contains(proxy.Host, ",") && !strings.Contains(proxy.Host, " ") {
+		if proxy.UseHost && proxy.Host != "" && !proxy.TLSPassthrough && !strings.Contains(proxy.Host, ",") && !strings.Contains(proxy.Host, " ") {
 			if removePorts {
 				hostnames = append(hostnames, strings.Split(proxy.Host, ":")[0])
 			} else {
@@ -801,11 +809,7 @@ func DownloadFileToLocation(path, url string) error {
 }
 
 func GetClientIP(req *http.Request) string {
-	/*ip := req.Header.Get("X-Forwarded-For")
-	if ip == "" {
-		ip = req.RemoteAddr
-	}*/
-	return req.RemoteAddr
+	return ResolveClientIP(req)
 }
 
 func IsDomain(domain string) bool {
@@ -868,6 +872,8 @@ func CheckPassword(nickname, password string) error {
 		return err3
 	} else if user.Password == "" {
 		return errors.New("User not registered")
+	} else if IsAccountLocked(user) {
+		return ErrAccountLocked
 	} else {
 		err2 := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password))
 